@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	m20 "github.com/metrics20/go-metrics20"
@@ -13,12 +14,18 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// clock is what we read the time from for metric timestamps (not for measuring durations).
+// it's a variable so that time dependent behavior can be made deterministic.
+var clock = time.Now
+
 func dieIfError(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Fatal error: %s\n", err.Error())
@@ -27,44 +34,233 @@ func dieIfError(err error) {
 }
 
 var (
-	verbose    bool
-	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-	memprofile = flag.String("memprofile", "", "write memory profile to this file")
-	configFile = flag.String("config", "carbon-tagger.conf", "config file")
+	verbose      bool
+	cpuprofile   = flag.String("cpuprofile", "", "write cpu profile to file")
+	memprofile   = flag.String("memprofile", "", "write memory profile to this file")
+	heapsnapshot = flag.String("heapsnapshot", "", "on SIGUSR1, write a heap profile to this path, suffixed with the time")
+	configFile   = flag.String("config", "carbon-tagger.conf", "config file")
+	configDir    = flag.String("config-dir", "", "directory with more config files (*.conf), loaded after -config in lexical order")
 
 	es_host         = config.String("elasticsearch.host", "undefined")
 	es_port         = config.Int("elasticsearch.port", 9200)
 	es_index_name   = config.String("elasticsearch.index", "graphite_metrics2")
 	es_flush_int    = config.Int("elasticsearch.flush_interval", 2)
 	es_max_backlog  = config.Int("elasticsearch.max_backlog", 1000) // if this many is in transit to indexer, start blocking
-	es_max_pending  = config.Int("elasticsearch.max_pending", 500)
+	es_max_pending  = config.Int("elasticsearch.max_pending", 500)  // superseded by elasticsearch.bulk_max_actions, if that is set
 	in_port         = config.Int("in.port", 2003)
 	stats_host      = config.String("stats.host", "localhost")
 	stats_port      = config.Int("stats.port", 2005)
 	stats_http_addr = config.String("stats.http_addr", "0.0.0.0:8123")
 
-	stats_id             *string
-	stats_flush_interval *int
+	out_host           = config.String("out.host", "") // where to forward lines to. forwarding is disabled if empty
+	out_port           = config.Int("out.port", 2003)
+	out_max_backlog    = config.Int("out.max_backlog", 10000)      // if this many lines are queued, start dropping
+	out_destinations   = config.String("out.destinations", "")     // comma separated host:port list. overrides out.host and out.port
+	out_routing        = config.String("out.routing", "broadcast") // or "consistent_hash", to send every metric to one destination
+	out_tee_raw        = config.Bool("out.tee_raw", false)         // forward all lines as received, instead of the valid ones as processed
+	out_gzip           = config.Bool("out.gzip", false)
+	out_gzip_flush_int = config.Int("out.gzip_flush_interval", 1000) // in ms
+
+	stats_buffer_flushes = config.Int("stats.buffer_flushes", 30) // if the stats can't be sent, keep this many submissions to send later
+
+	stats_as_proto2 = config.Bool("stats.as_proto2", false) // send stats through our own input, to be indexed and forwarded
+
+	in_force_proto   = config.String("in.force_proto", "auto")    // "1" or "2" to skip protocol detection
+	in_quoted_values = config.Bool("in.quoted_values", false)     // allow spaces in double quoted tag values
+	in_framing       = config.String("in.framing", "newline")     // or "length_prefixed"
+	in_keep_partial  = config.Bool("in.keep_partial_line", false) // process the last line of a cleanly closed connection, even without newline
+	in_max_frame_len = config.Int("in.max_frame_len", 1<<20)      // in bytes, for length_prefixed framing
+	in_ip_blocklist  = config.String("in.ip_blocklist", "")       // comma separated IPs/CIDRs to refuse connections from
+	in_ip_allowlist  = config.String("in.ip_allowlist", "")       // if set, only accept connections from these IPs/CIDRs
+	in_drain_period  = config.Int("in.drain_period", 60)          // after a port change, how long connections on the old port may stay open
+
+	in_tls_cert      = config.String("in.tls_cert", "") // with in.tls_key, accept TLS connections only
+	in_tls_key       = config.String("in.tls_key", "")
+	in_tls_client_ca = config.String("in.tls_client_ca", "") // if set, require client certificates signed by this CA
+	in_identity_tag  = config.String("in.identity_tag", "")  // if set, tag proto2 metrics with the client certificate's identity
+
+	log_status_interval = config.Int("log.status_interval", 0) // in seconds. 0 to disable
+
+	in_max_value_len = config.Int("in.max_value_len", 64) // longer value fields get the line rejected
+	in_max_ts_len    = config.Int("in.max_timestamp_len", 20)
+
+	in_line_splitter = config.String("in.line_splitter", "") // if set, lines can hold several records, separated by this
+
+	es_alias           = config.String("elasticsearch.alias", "")           // if set, write to this alias instead of the index
+	es_secondary_index = config.String("elasticsearch.secondary_index", "") // if set, also write new metrics here (for reindexing)
+	es_upsert          = config.Bool("elasticsearch.upsert", false)         // merge into existing documents instead of replacing them
+	es_route_by_tag    = config.String("elasticsearch.route_by_tag", "")    // if set, proto2 metrics go to an index per value of this tag
+	es_op_timeout      = config.Int("elasticsearch.op_timeout", 30)         // in seconds. 0 for no timeout
+	es_max_inflight    = config.Int("elasticsearch.max_inflight", 0)        // max concurrent bulk requests across indexers. 0 for no limit
+	es_max_doc_bytes   = config.Int("elasticsearch.max_doc_bytes", 0)       // skip metrics with bigger documents. 0 for no limit
+
+	es_tag_layout       = config.String("elasticsearch.tag_layout", "kv_list") // or "nested" or "flat". see esDoc
+	es_derive_semantics = config.Bool("elasticsearch.derive_semantics", false) // add a value_semantics field, see valueSemantics
+
+	es_bulk_max_actions = config.Int("elasticsearch.bulk_max_actions", 0)   // send a bulk request once it has this many documents
+	es_bulk_max_bytes   = config.Int("elasticsearch.bulk_max_bytes", 16384) // or this many bytes
 
+	es_shed_high_water = config.Int("elasticsearch.shed_high_water", 0) // proto2 queue depth at which we start sampling new metrics. 0 to disable
+	es_shed_sample     = config.Int("elasticsearch.shed_sample", 10)    // while shedding, index 1 in this many new metrics
+
+	parse_trim_empty_nodes   = config.Bool("parse.trim_empty_nodes", false)   // if false, metrics with empty nodes are rejected
+	parse_require_all_tagged = config.Bool("parse.require_all_tagged", false) // reject metrics with old-style nodes
+	parse_max_positional     = config.Int("parse.max_positional_tags", 0)     // reject metrics with more old-style nodes than this. 0 for no limit
+	parse_ps_adds_rate_tag   = config.Bool("parse.ps_adds_rate_tag", false)   // tag metrics with a rate unit (e.g. "ps") with parse.rate_tag
+	parse_rate_tag           = config.String("parse.rate_tag", "target_type=rate")
+	parse_unit_rewrites      = config.String("parse.unit_rewrites", "ps:/s,pm:/m,ph:/h")
+	parse_unit_exceptions    = config.String("parse.unit_rewrite_exceptions", "")                  // units that look like rates but aren't
+	parse_id_transforms      = config.String("parse.id_transforms", "")                            // see transform.go
+	parse_tag_key_pattern    = config.String("parse.tag_key_pattern", "^[a-zA-Z_][a-zA-Z0-9_-]*$") // empty to allow any tag key
+	parse_shadow             = config.Bool("parse.shadow", false)                                  // also parse with the candidate parser and count disagreements, see shadow.go
+	parse_shadow_log_int     = config.Int("parse.shadow_log_interval", 10)                         // log at most one disagreement per this many seconds
+	parse_detect_typos       = config.Bool("parse.detect_typos", false)                            // count proto1 metrics that look like misspelled proto2
+	parse_metadata_only      = config.Bool("parse.allow_metadata_only", false)                     // accept lines with just a metric id: index it, but don't forward anything
+
+	parse_node_separator = config.String("parse.node_separator", ".") // e.g. "/" or ":" instead of dots
+	parse_default_unit   = config.String("parse.default_unit", "")    // unit for proto2 metrics without one. empty to reject them
+
+	parse_timestamp_unit = config.String("parse.timestamp_unit", "none") // or "seconds", "millis" or "auto". see normalizeTimestamp
+
+	promwrite_enabled     = config.Bool("promwrite.enabled", false)
+	promwrite_url         = config.String("promwrite.url", "http://localhost:9090/api/v1/write")
+	promwrite_name_tag    = config.String("promwrite.name_tag", "what") // tag to use as metric name for proto2 metrics
+	promwrite_batch_size  = config.Int("promwrite.batch_size", 500)
+	promwrite_flush_int   = config.Int("promwrite.flush_interval", 1)
+	promwrite_max_backlog = config.Int("promwrite.max_backlog", 10000) // if this many samples are queued, start dropping
+	promwrite_max_retries = config.Int("promwrite.max_retries", 3)
+	promwrite_timeout     = config.Int("promwrite.timeout", 10)
+
+	stats_timer_sample = config.Int("stats.timer_sample", 100) // time only 1 in this many parse and index calls
+
+	webhook_enabled     = config.Bool("webhook.enabled", false)
+	webhook_url         = config.String("webhook.url", "")
+	webhook_batch_size  = config.Int("webhook.batch_size", 100)
+	webhook_flush_int   = config.Int("webhook.flush_interval", 5) // post at most this often
+	webhook_max_backlog = config.Int("webhook.max_backlog", 10000)
+	webhook_timeout     = config.Int("webhook.timeout", 10)
+
+	stats_id             = config.String("stats.id", "myhost")
+	stats_flush_interval = config.Int("stats.flush_interval", 10)
+
+	num_goroutines               stat
+	in_paused                    stat
 	in_conns_current             stat
 	in_conns_broken_total        stat
+	in_conns_timeout_total       stat
+	in_conns_accepted_total      stat
+	in_conns_accept_errors_total stat
+	in_conns_refused_total       stat
+	in_conns_unterminated_total  stat
+	in_conns_tls_failed_total    stat
 	in_metrics_proto1_good_total stat
 	in_metrics_proto2_good_total stat
 	in_metrics_proto1_bad_total  stat
+	in_metrics_proto2_typo_total stat
+	in_metadata_only_total       stat
 	in_metrics_proto2_bad_total  stat
 	in_lines_bad_total           stat
 	num_seen_proto2              stat
 	num_seen_proto1              stat
+	num_indexed_proto1           stat // unique metrics indexed since start
+	num_indexed_proto2           stat
 	pending_backlog_proto1       stat // backlog in our queue (excl elastigo queue)
 	pending_backlog_proto2       stat // backlog in our queue (excl elastigo queue)
 	pending_es_proto1            stat
 	pending_es_proto2            stat
+	es_inflight                  stat
+	es_timeouts_total            stat
+	es_docs_too_big_total        stat
+	es_shed_total                stat
+	es_sample_every              stat
+
+	in_lines_field_too_long_total stat // also counted in in_lines_bad_total
+	in_lines_bad_ts_total         stat // also counted in in_lines_bad_total
+	in_lines_ts_converted_total   stat
+	in_frames_bad_total           stat
+	in_records_empty_total        stat
+	parse_shadow_diverged_total   stat
+	in_default_unit_total         stat
 
-	lines_read  chan []byte
-	proto1_read chan string
-	proto2_read chan m20.MetricSpec
+	// proto2 rejection reasons (also counted in in_metrics_proto2_bad_total)
+	in_metrics_proto2_empty_node_total      stat
+	in_metrics_proto2_invalid_tag_key_total stat
+	in_metrics_proto2_untagged_node_total   stat
+	in_metrics_proto2_too_positional_total  stat
+
+	promwrite_sent_total      stat
+	promwrite_dropped_total   stat
+	promwrite_invalid_total   stat
+	promwrite_errors_total    stat
+	pending_backlog_promwrite stat
+
+	webhook_sent_total    stat
+	webhook_dropped_total stat
+	webhook_errors_total  stat
+
+	stats_flushes_dropped_total stat
+
+	parse_timer    *sampledTimer
+	es_index_timer *sampledTimer
+
+	tags_per_metric metrics.Histogram
+
+	lines_read     chan inLine
+	destinations   []*destination // where we forward lines to
+	out_ring       *ring          // with out.routing = consistent_hash
+	proto1_read    chan string
+	proto2_read    chan trackedMetric
+	promwrite_read chan promSample
+	webhook_events chan webhookEvent
+)
+
+// protocol hints that come with lines from a listener
+const (
+	protoAuto = iota // classify each metric
+	proto1
+	proto2
 )
 
+// inLine is a line as read from a connection, with the protocol hint of its listener
+type inLine struct {
+	buf    []byte
+	proto  int
+	source string // remote address of the connection
+	sender string // identity of the client's TLS certificate, if any
+}
+
+// trackedMetric is a valid proto2 metric, with the remote address it came from
+type trackedMetric struct {
+	m20.MetricSpec
+	source string
+}
+
+func parseProtoHint(hint string) (int, error) {
+	switch hint {
+	case "auto":
+		return protoAuto, nil
+	case "1":
+		return proto1, nil
+	case "2":
+		return proto2, nil
+	}
+	return 0, fmt.Errorf("invalid protocol '%s', should be one of auto, 1 or 2", hint)
+}
+
+// checkStatsAsProto2 checks that our input accepts the stats, for stats.as_proto2.
+// the stats are sent as proto2 lines, one per line, over plain tcp.
+func checkStatsAsProto2(proto int, framing string, tls bool) error {
+	switch {
+	case framing != "newline":
+		return fmt.Errorf("stats.as_proto2 requires in.framing = newline, not %s", framing)
+	case proto == proto1:
+		return fmt.Errorf("stats.as_proto2 doesn't work with in.force_proto = 1, the stats are proto2")
+	case tls:
+		return fmt.Errorf("stats.as_proto2 doesn't work with TLS (in.tls_cert)")
+	}
+	return nil
+}
+
 func init() {
 	flag.BoolVar(&verbose, "verbose", false, "print invalid lines and metrics")
 }
@@ -82,64 +278,150 @@ func main() {
 		f, err := os.Create(*memprofile)
 		dieIfError(err)
 		defer f.Close()
-		defer pprof.WriteHeapProfile(f)
+		defer func() {
+			runtime.GC() // so the profile reflects the heap as it is now, not as of the last GC
+			pprof.WriteHeapProfile(f)
+		}()
 	}
 
-	stats_id = config.String("stats.id", "myhost")
-	stats_flush_interval = config.Int("stats.flush_interval", 10)
-	err := config.Parse(*configFile)
+	err := parseConfig()
 	dieIfError(err)
+	if *parse_ps_adds_rate_tag && strings.Count(*parse_rate_tag, "=") != 1 {
+		dieIfError(fmt.Errorf("parse.rate_tag must be of the form key=val, not '%s'", *parse_rate_tag))
+	}
+	err = initUnitRewrites(*parse_unit_rewrites, *parse_unit_exceptions)
+	dieIfError(err)
+	err = checkNodeSeparator(*parse_node_separator)
+	dieIfError(err)
+	switch *parse_timestamp_unit {
+	case "none", "seconds", "millis", "auto":
+	default:
+		dieIfError(fmt.Errorf("invalid parse.timestamp_unit '%s', should be none, seconds, millis or auto", *parse_timestamp_unit))
+	}
+	if *parse_tag_key_pattern != "" {
+		tag_key_pattern, err = regexp.Compile(*parse_tag_key_pattern)
+		dieIfError(err)
+	}
+	err = initIdTransforms(*parse_id_transforms)
+	dieIfError(err)
+	if *parse_shadow && candidateParser == nil {
+		dieIfError(fmt.Errorf("parse.shadow is enabled, but there is no candidate parser. build with -tags parser_candidate"))
+	}
+	if *es_shed_high_water > 0 && *es_shed_sample < 1 {
+		dieIfError(fmt.Errorf("elasticsearch.shed_sample must be at least 1, not %d", *es_shed_sample))
+	}
+	if *es_tag_layout != "kv_list" && *es_tag_layout != "nested" && *es_tag_layout != "flat" {
+		dieIfError(fmt.Errorf("invalid elasticsearch.tag_layout '%s', should be kv_list, nested or flat", *es_tag_layout))
+	}
+	if *in_framing != "newline" && *in_framing != "length_prefixed" {
+		dieIfError(fmt.Errorf("invalid in.framing '%s', should be newline or length_prefixed", *in_framing))
+	}
+	// frames are forwarded as the lines in them, so we couldn't forward what we received
+	if *out_tee_raw && *in_framing == "length_prefixed" {
+		dieIfError(fmt.Errorf("out.tee_raw can't be combined with in.framing = length_prefixed"))
+	}
+	if *in_line_splitter != "" && (strings.TrimSpace(*in_line_splitter) != *in_line_splitter || strings.ContainsAny(*in_line_splitter, " .=")) {
+		dieIfError(fmt.Errorf("invalid in.line_splitter '%s', can't contain spaces, dots or '='", *in_line_splitter))
+	}
+	in_tls, err = loadTLSConfig(*in_tls_cert, *in_tls_key, *in_tls_client_ca)
+	dieIfError(err)
+	if *in_identity_tag != "" && *in_tls_client_ca == "" {
+		dieIfError(fmt.Errorf("in.identity_tag requires client certificates, i.e. in.tls_client_ca"))
+	}
+	if *in_identity_tag != "" && tag_key_pattern != nil && !tag_key_pattern.MatchString(*in_identity_tag) {
+		dieIfError(fmt.Errorf("in.identity_tag '%s' doesn't match parse.tag_key_pattern", *in_identity_tag))
+	}
+	filter, err := newIpFilter(*in_ip_blocklist, *in_ip_allowlist)
+	dieIfError(err)
+	setIpFilter(filter)
+	in_proto, err := parseProtoHint(*in_force_proto)
+	dieIfError(err)
+	if *stats_buffer_flushes < 0 {
+		dieIfError(fmt.Errorf("stats.buffer_flushes must be at least 0, not %d", *stats_buffer_flushes))
+	}
+	if *stats_as_proto2 {
+		err = checkStatsAsProto2(in_proto, *in_framing, in_tls != nil)
+		dieIfError(err)
+	}
 
-	in_conns_current = NewGauge("unit_is_Conn.direction_is_in.type_is_open", false)
-	in_conns_broken_total = NewCounter("unit_is_Conn.direction_is_in.type_is_broken", false)
-	in_metrics_proto1_good_total = NewCounter("unit_is_Metric.proto_is_1.direction_is_in.type_is_good", false) // no thorough check
-	in_metrics_proto2_good_total = NewCounter("unit_is_Metric.proto_is_2.direction_is_in.type_is_good", false)
-	in_metrics_proto1_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_1.direction_is_in", false)
-	in_metrics_proto2_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_2.direction_is_in", false)
-	in_lines_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_line.direction_is_in", false)
-	num_seen_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_tracked", true)
-	num_seen_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_tracked", true)
-	pending_backlog_proto1 = NewCounter("unit_is_Metric.proto_is_1.type_is_pending_in_backlog", true)
-	pending_backlog_proto2 = NewCounter("unit_is_Metric.proto_is_2.type_is_pending_in_backlog", true)
-	pending_es_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_pending_in_es", true)
-	pending_es_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_pending_in_es", true)
+	initStats()
+	// bulk requests are relatively rare and sent from several goroutines, so we bypass the sampling and time them all
+	es_bulk_timer := NewTimer("unit_is_ns.what_is_bulk_request_duration.target_is_es", 1)
 
-	lines_read = make(chan []byte)
+	lines_read = make(chan inLine)
 	proto1_read = make(chan string, *es_max_backlog)
-	proto2_read = make(chan m20.MetricSpec, *es_max_backlog)
+	proto2_read = make(chan trackedMetric, *es_max_backlog)
 
 	// connect to elasticsearch database to store tags
 	es := elastigo.NewConn()
 	es.Domain = *es_host
 	es.Port = strconv.Itoa(*es_port)
+	// elastigo always uses the default http client, so this is the only way to put a bound on its requests.
+	// our other http clients (prometheus, webhook) have their own timeouts
+	http.DefaultClient.Timeout = time.Duration(*es_op_timeout) * time.Second
 
-	indexer1 := es.NewBulkIndexer(4)
-	indexer1.BulkMaxDocs = *es_max_pending
-	indexer1.BufferDelayMax = time.Duration(*es_flush_int) * time.Second
-	indexer1.Start()
+	var inflight chan bool
+	if *es_max_inflight > 0 {
+		inflight = make(chan bool, *es_max_inflight)
+	}
 
-	indexer2 := es.NewBulkIndexer(4)
-	indexer1.BulkMaxDocs = *es_max_pending
-	indexer1.BufferDelayMax = time.Duration(*es_flush_int) * time.Second
-	indexer2.Start()
+	fmt.Printf("ES bulk requests are sent at %d documents or %d bytes, or after %ds\n", bulkMaxActions(), *es_bulk_max_bytes, *es_flush_int)
+	indexer1 := newIndexer(es, es_bulk_timer, inflight)
+	indexer2 := newIndexer(es, es_bulk_timer, inflight)
 
+	for _, addr := range outDestinations() {
+		dest := newDestination(addr)
+		destinations = append(destinations, dest)
+		go dest.forwardLines()
+	}
+	if *out_routing == "consistent_hash" {
+		if len(destinations) > 0 {
+			out_ring = newRing(destinations)
+		}
+	} else if *out_routing != "broadcast" {
+		dieIfError(fmt.Errorf("invalid out.routing '%s', should be broadcast or consistent_hash", *out_routing))
+	}
+	if *promwrite_enabled {
+		promwrite_read = make(chan promSample, *promwrite_max_backlog)
+		go promWrite()
+	}
+	if *webhook_enabled {
+		webhook_events = make(chan webhookEvent, *webhook_max_backlog)
+		go postWebhooks()
+	}
 	go processInputLines()
 	// 1 worker, but ES library has multiple workers
-	go trackProto1(indexer1, *es_index_name)
-	go trackProto2(indexer2, *es_index_name)
+	targets := esTargets()
+	go trackProto1(indexer1, targets)
+	go trackProto2(indexer2, targets)
+	if *log_status_interval > 0 {
+		go logStatus(time.Duration(*log_status_interval)*time.Second, targets, indexer1, indexer2)
+	}
 
-	statsAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", *stats_host, *stats_port))
-	dieIfError(err)
-	go metrics.Graphite(metrics.DefaultRegistry, time.Duration(*stats_flush_interval)*time.Second, "", statsAddr)
+	// stats are already in proto2 format. normally we send them straight to the stats host,
+	// but we can also send them to ourself, so they get indexed and forwarded like any other metric
+	statsDest := fmt.Sprintf("%s:%d", *stats_host, *stats_port)
+	if *stats_as_proto2 {
+		statsDest = fmt.Sprintf("127.0.0.1:%d", *in_port)
+	}
+	statsConfig := metrics.GraphiteConfig{
+		Registry:      metrics.DefaultRegistry,
+		FlushInterval: time.Duration(*stats_flush_interval) * time.Second,
+		DurationUnit:  time.Nanosecond,
+		Percentiles:   []float64{0.5, 0.75, 0.95, 0.99, 0.999},
+	}
+	stats := newStatsReporter(statsDest, statsConfig)
+	go stats.run()
 
 	// listen for incoming metrics
-	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", *in_port))
-	dieIfError(err)
-	listener, err := net.ListenTCP("tcp", addr)
+	in_listener, err := newListener(*in_port, in_proto)
 	dieIfError(err)
-	defer listener.Close()
 	go func() {
 		exp.Exp(metrics.DefaultRegistry)
+		http.Handle("/flush", flushHandler(indexer1, indexer2))
+		http.HandleFunc("/pause", pauseHandler)
+		http.HandleFunc("/resume", resumeHandler)
+		http.Handle("/parse", parseHandler(in_proto))
 		fmt.Printf("carbon-tagger %s expvar web on %s\n", *stats_id, *stats_http_addr)
 		err := http.ListenAndServe(*stats_http_addr, nil)
 		if err != nil {
@@ -148,64 +430,275 @@ func main() {
 		}
 	}()
 
-	fmt.Printf("carbon-tagger %s listening on %d\n", *stats_id, *in_port)
-	for {
-		// would be nice to have a metric showing highest amount of connections seen per interval
-		conn_in, err := listener.Accept()
+	go in_listener.serve()
+	listeners := handleSignals(in_listener, func(port int) {
+		if *stats_as_proto2 {
+			stats.setDest(fmt.Sprintf("127.0.0.1:%d", port))
+		}
+	})
+
+	ingest.resume() // connections can't finish while they're paused
+	for _, l := range listeners {
+		l.shutdown()
+	}
+	waitDrained(time.Duration(*in_drain_period) * time.Second)
+	indexer1.Flush()
+	indexer2.Flush()
+	// with stats.as_proto2 the stats would go to the input we just closed
+	if !*stats_as_proto2 {
+		err = stats.flush()
 		if err != nil {
-			fmt.Fprint(os.Stderr, err)
-			continue
+			fmt.Printf("WARN could not submit stats: %s\n", err.Error())
 		}
-		go handleClient(conn_in)
 	}
+	fmt.Println("shut down")
+}
+
+// initStats creates all our stats, except for the per-target and per-destination ones
+func initStats() {
+	// every connection has its own goroutine, so if connections linger, this is where leaks show up
+	num_goroutines = NewGauge("unit_is_Goroutine.type_is_running", true)
+	go func() {
+		for _ = range num_goroutines.valueReq {
+			num_goroutines.valueResp <- int64(runtime.NumGoroutine())
+		}
+	}()
+	in_paused = NewGauge("unit_is_Bool.direction_is_in.type_is_paused", false)
+	in_conns_current = NewGauge("unit_is_Conn.direction_is_in.type_is_open", false)
+	in_conns_broken_total = NewCounter("unit_is_Conn.direction_is_in.type_is_broken", false) // excludes timeouts
+	in_conns_timeout_total = NewCounter("unit_is_Conn.direction_is_in.type_is_timeout", false)
+	in_conns_accepted_total = NewCounter("unit_is_Conn.direction_is_in.type_is_accepted", false)
+	in_conns_accept_errors_total = NewCounter("unit_is_Err.orig_unit_is_Conn.direction_is_in.type_is_accept_failed", false)
+	in_conns_refused_total = NewCounter("unit_is_Conn.direction_is_in.type_is_refused", false)
+	in_conns_tls_failed_total = NewCounter("unit_is_Conn.direction_is_in.type_is_tls_handshake_failed", false)
+	in_conns_unterminated_total = NewCounter("unit_is_Conn.direction_is_in.type_is_closed_with_unterminated_line", false)
+	in_metrics_proto1_good_total = NewCounter("unit_is_Metric.proto_is_1.direction_is_in.type_is_good", false) // no thorough check
+	in_metrics_proto2_good_total = NewCounter("unit_is_Metric.proto_is_2.direction_is_in.type_is_good", false)
+	in_metrics_proto1_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_1.direction_is_in", false)
+	in_metadata_only_total = NewCounter("unit_is_Metric.direction_is_in.type_is_metadata_only", false)
+	in_default_unit_total = NewCounter("unit_is_Metric.proto_is_2.direction_is_in.type_is_default_unit_applied", false)
+	in_metrics_proto2_typo_total = NewCounter("unit_is_Metric.proto_is_1.direction_is_in.type_is_suspected_proto2_typo", false)
+	in_metrics_proto2_bad_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid.proto_is_2.direction_is_in", false)
+	in_metrics_proto2_too_positional_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_too_many_positional_tags.proto_is_2.direction_is_in", false)
+	in_metrics_proto2_empty_node_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_empty_node.proto_is_2.direction_is_in", false)
+	in_metrics_proto2_invalid_tag_key_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_invalid_tag_key.proto_is_2.direction_is_in", false)
+	in_metrics_proto2_untagged_node_total = NewCounter("unit_is_Err.orig_unit_is_Metric.type_is_untagged_node.proto_is_2.direction_is_in", false)
+	in_lines_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_line.direction_is_in", false)
+	in_lines_field_too_long_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_field_too_long.direction_is_in", false)
+	in_lines_bad_ts_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_timestamp.direction_is_in", false)
+	in_lines_ts_converted_total = NewCounter("unit_is_Msg.direction_is_in.type_is_timestamp_converted", false)
+	parse_shadow_diverged_total = NewCounter("unit_is_Metric.direction_is_in.type_is_shadow_parse_diverged", false)
+	in_records_empty_total = NewCounter("unit_is_Msg.direction_is_in.type_is_empty_record", false)
+	in_frames_bad_total = NewCounter("unit_is_Err.orig_unit_is_Msg.type_is_invalid_frame.direction_is_in", false)
+	num_seen_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_tracked", true)
+	num_seen_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_tracked", true)
+	num_indexed_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_indexed_unique", true)
+	num_indexed_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_indexed_unique", true)
+	pending_backlog_proto1 = NewCounter("unit_is_Metric.proto_is_1.type_is_pending_in_backlog", true)
+	pending_backlog_proto2 = NewCounter("unit_is_Metric.proto_is_2.type_is_pending_in_backlog", true)
+	pending_es_proto1 = NewGauge("unit_is_Metric.proto_is_1.type_is_pending_in_es", true)
+	pending_es_proto2 = NewGauge("unit_is_Metric.proto_is_2.type_is_pending_in_es", true)
+	es_shed_total = NewCounter("unit_is_Metric.proto_is_2.direction_is_out.target_is_es.type_is_shed", false)
+	es_sample_every = NewGauge("unit_is_Metric.proto_is_2.target_is_es.type_is_index_sample_interval", false)
+	es_sample_every.Update(1)
+	es_docs_too_big_total = NewCounter("unit_is_Metric.direction_is_out.target_is_es.type_is_doc_too_big", false)
+	es_timeouts_total = NewCounter("unit_is_Err.orig_unit_is_Req.direction_is_out.target_is_es.type_is_timeout", false)
+	es_inflight = NewGauge("unit_is_Req.direction_is_out.target_is_es.type_is_inflight", false)
+	tags_per_metric = NewHistogram("unit_is_Tag.what_is_tags_per_metric.proto_is_2")
+	parse_timer = NewTimer("unit_is_ns.what_is_parse_duration.proto_is_2", *stats_timer_sample)
+	es_index_timer = NewTimer("unit_is_ns.what_is_index_call_duration.proto_is_2.target_is_es", *stats_timer_sample)
+
+	promwrite_sent_total = NewCounter("unit_is_Metric.direction_is_out.target_is_promwrite.type_is_sent", false)
+	promwrite_dropped_total = NewCounter("unit_is_Err.orig_unit_is_Metric.direction_is_out.target_is_promwrite.type_is_dropped", false)
+	promwrite_invalid_total = NewCounter("unit_is_Err.orig_unit_is_Metric.direction_is_out.target_is_promwrite.type_is_invalid_value", false)
+	promwrite_errors_total = NewCounter("unit_is_Err.orig_unit_is_Req.direction_is_out.target_is_promwrite.type_is_failed", false)
+	pending_backlog_promwrite = NewCounter("unit_is_Metric.target_is_promwrite.type_is_pending_in_backlog", *promwrite_enabled)
+	webhook_sent_total = NewCounter("unit_is_Metric.direction_is_out.target_is_webhook.type_is_sent", false)
+	webhook_dropped_total = NewCounter("unit_is_Err.orig_unit_is_Metric.direction_is_out.target_is_webhook.type_is_dropped", false)
+	webhook_errors_total = NewCounter("unit_is_Err.orig_unit_is_Req.direction_is_out.target_is_webhook.type_is_failed", false)
+	stats_flushes_dropped_total = NewCounter("unit_is_Err.orig_unit_is_Req.direction_is_out.target_is_stats.type_is_dropped", false)
 }
 
-func handleClient(conn_in net.Conn) {
+func handleClient(conn_in net.Conn, proto int) {
 	in_conns_current.Inc(1)
 	defer in_conns_current.Dec(1)
 	defer conn_in.Close()
+	source := conn_in.RemoteAddr().String()
+	sender := ""
+	if tlsConn, ok := conn_in.(*tls.Conn); ok {
+		var err error
+		sender, err = clientIdentity(tlsConn)
+		if err != nil {
+			fmt.Printf("WARN TLS handshake with %s failed: %s\n", source, err.Error())
+			in_conns_tls_failed_total.Inc(1)
+			return
+		}
+	}
 	reader := bufio.NewReader(conn_in)
+	if *in_framing == "length_prefixed" {
+		err := readFrames(reader, proto, source, sender)
+		if ferr, ok := err.(framingError); ok {
+			fmt.Printf("WARN framing error, dropping connection: %s\n", ferr.Error())
+			in_frames_bad_total.Inc(1)
+		} else {
+			countReadError(err)
+		}
+		return
+	}
 	for {
+		ingest.wait()
 		// TODO handle isPrefix cases (means we should merge this read with the next one in a different packet, i think)
 		buf, err := reader.ReadBytes('\n')
 		if err != nil {
 			str := strings.TrimSpace(string(buf))
-			if err != io.EOF {
-				fmt.Printf("WARN connection closed uncleanly/broken: %s\n", err.Error())
-				in_conns_broken_total.Inc(1)
-			}
+			countReadError(err)
 			if len(str) > 0 {
-				// todo handle incomplete reads
+				in_conns_unterminated_total.Inc(1)
+				// the sender closed the connection without terminating its last line.
+				// if it closed cleanly, the line may well be complete, so we can give it a chance.
+				if err == io.EOF && *in_keep_partial {
+					received(inLine{append(buf, '\n'), proto, source, sender})
+					return
+				}
 				fmt.Printf("WARN incomplete read, line read: '%s'. neglecting line because connection closed because of %s\n", str, err.Error())
 			}
 			return
 		}
-		lines_read <- buf
+		received(inLine{buf, proto, source, sender})
+	}
+}
+
+// countReadError accounts for the error that ended the reading from a connection.
+// timeouts are counted apart from broken connections, so that the latter is a reliable signal. EOF is a clean close.
+func countReadError(err error) {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		fmt.Printf("WARN connection timed out: %s\n", err.Error())
+		in_conns_timeout_total.Inc(1)
+	} else if err != io.EOF {
+		fmt.Printf("WARN connection closed uncleanly/broken: %s\n", err.Error())
+		in_conns_broken_total.Inc(1)
+	}
+}
+
+// received passes a line we read from a client on to processInputLines.
+// with out.tee_raw, this is also where it gets forwarded, exactly as we received it.
+func received(line inLine) {
+	if *out_tee_raw {
+		forward(rawId(line.buf), line.buf)
+	}
+	if *in_line_splitter == "" {
+		lines_read <- line
+		return
+	}
+	records, empty := splitRecords(line.buf, *in_line_splitter)
+	in_records_empty_total.Inc(int64(empty))
+	for _, rec := range records {
+		lines_read <- inLine{rec, line.proto, line.source, line.sender}
+	}
+}
+
+// checkedLine is an input line with the fields we need, see checkLine
+type checkedLine struct {
+	elements     []string
+	buf          []byte // the line to forward. same as the input, unless we converted the timestamp
+	metadataOnly bool   // just a metric id, see parse.allow_metadata_only
+	tsConverted  bool
+}
+
+// checkLine splits a line into its fields and checks them, before we look at the metric id.
+// for the problems that have a stat of their own, the error is a rejection.
+func checkLine(buf []byte) (checkedLine, error) {
+	str := strings.TrimSpace(string(buf))
+	elements, err := splitLine(str)
+	if err != nil {
+		return checkedLine{}, err
+	}
+	// with parse.allow_metadata_only, a line can be just a metric id, to get it indexed without sending a datapoint
+	l := checkedLine{elements, buf, *parse_metadata_only && len(elements) == 1 && elements[0] != "", false}
+	if len(elements) != 3 && !l.metadataOnly {
+		return l, fmt.Errorf("line has !=3 elements: %s", str)
 	}
+	if l.metadataOnly {
+		return l, nil
+	}
+	// cheap guard against adversarial input, before anything tries to parse these fields as numbers
+	if len(elements[1]) > *in_max_value_len || len(elements[2]) > *in_max_ts_len {
+		return l, rejection{&in_lines_field_too_long_total, fmt.Sprintf("line has a value or timestamp field that's too long: %.100s...", str)}
+	}
+	ts, converted, err := normalizeTimestamp(elements[2])
+	if err != nil {
+		return l, rejection{&in_lines_bad_ts_total, err.Error()}
+	}
+	if converted {
+		l.tsConverted = true
+		elements[2] = ts
+		l.buf = withId(elements[0], elements)
+	}
+	return l, nil
+}
+
+// isProto2Line classifies a metric id, given the protocol hint of its listener
+func isProto2Line(hint int, id string) bool {
+	return hint == proto2 || hint == protoAuto && isProto2(id)
 }
 
 func processInputLines() {
-	for buf := range lines_read {
-		str := strings.TrimSpace(string(buf))
-		elements := strings.Split(str, " ")
-		if len(elements) != 3 {
+	for line := range lines_read {
+		ingest.wait()
+		l, err := checkLine(line.buf)
+		if err != nil {
 			if verbose {
-				fmt.Println("line has !=3 elements:", str)
+				fmt.Println(err)
+			}
+			if r, ok := err.(rejection); ok {
+				r.reason.Inc(1)
 			}
 			in_lines_bad_total.Inc(1)
 			continue
 		}
-		id := elements[0]
-		if m20.IsMetric20(id) {
-			metric, err := m20.NewMetricSpec(id)
+		if l.tsConverted {
+			in_lines_ts_converted_total.Inc(1)
+		}
+		buf, elements, metadataOnly := l.buf, l.elements, l.metadataOnly
+		id := transformId(elements[0])
+		if isProto2Line(line.proto, id) {
+			pre := parse_timer.Start()
+			metric, defaultUnit, err := parseTagBasedMetric(id)
+			parse_timer.Stop(pre)
+			if *parse_shadow {
+				shadowParse(id, metric, err)
+			}
 			if err != nil {
 				if verbose {
 					fmt.Println(err)
 				}
+				if r, ok := err.(rejection); ok {
+					r.reason.Inc(1)
+				}
 				in_metrics_proto2_bad_total.Inc(1)
 			} else {
 				in_metrics_proto2_good_total.Inc(1)
-				proto2_read <- *metric
+				if defaultUnit {
+					in_default_unit_total.Inc(1)
+				}
+				tags_per_metric.Update(int64(len(metric.Tags)))
+				if *in_identity_tag != "" && line.sender != "" {
+					metric.Tags[*in_identity_tag] = line.sender
+				}
+				proto2_read <- trackedMetric{*metric, line.source}
+				if metadataOnly {
+					in_metadata_only_total.Inc(1)
+					continue
+				}
+				if metric.Id != elements[0] {
+					buf = withId(metric.Id, elements)
+				}
+				if !*out_tee_raw {
+					forward(metric.Id, buf)
+				}
+				if promwrite_read != nil {
+					queuePromSample(promLabelsProto2(metric.Id, metric.Tags), elements[1], elements[2])
+				}
 			}
 		} else {
 			err := m20.InitialValidation(id, m20.Legacy)
@@ -216,31 +709,55 @@ func processInputLines() {
 				in_metrics_proto1_bad_total.Inc(1)
 			} else {
 				in_metrics_proto1_good_total.Inc(1)
-				proto1_read <- elements[0]
+				if *parse_detect_typos && looksLikeProto2Typo(id) {
+					if verbose {
+						fmt.Println("proto1 metric looks like a proto2 metric with a typo:", id)
+					}
+					in_metrics_proto2_typo_total.Inc(1)
+				}
+				proto1_read <- id
+				if metadataOnly {
+					in_metadata_only_total.Inc(1)
+					continue
+				}
+				if id != elements[0] {
+					buf = withId(id, elements)
+				}
+				if !*out_tee_raw {
+					forward(id, buf)
+				}
+				if promwrite_read != nil {
+					queuePromSample(promLabelsProto1(id), elements[1], elements[2])
+				}
 			}
 		}
 	}
 }
 
-func trackProto1(indexer *elastigo.BulkIndexer, index_name string) {
+// trackProto1 and trackProto2 index the metrics they haven't seen before. they return when their channel is closed (only tests do that)
+func trackProto1(indexer Indexer, targets []esTarget) {
 	seenEs := make(map[string]bool)    // for ES. seen once = never need to resubmit
 	seenStats := make(map[string]bool) // for stats, provides "how many recently seen?"
 	for {
 		select {
-		case str := <-proto1_read:
+		case str, ok := <-proto1_read:
+			if !ok {
+				return
+			}
 			seenStats[str] = true
 			if _, ok := seenEs[str]; ok {
 				continue
 			}
-			date := time.Now()
-			refresh := false // we can wait until the regular indexing runs
-			metric_es := m20.MetricEs{Tags: make([]string, 0)}
-			err := indexer.Index(index_name, "metric", str, "", &date, &metric_es, refresh)
-			dieIfError(err)
+			date := clock()
+			metric_es := esDoc(m20.MetricSpec{Id: str})
+			indexEs(indexer, targets, str, &date, metric_es, "")
 			seenEs[str] = true
 		case <-num_seen_proto1.valueReq:
 			num_seen_proto1.valueResp <- int64(len(seenStats))
 			seenStats = make(map[string]bool)
+		case <-num_indexed_proto1.valueReq:
+			// seenEs is never pruned, so this is exact
+			num_indexed_proto1.valueResp <- int64(len(seenEs))
 		case <-pending_backlog_proto1.valueReq:
 			pending_backlog_proto1.valueResp <- int64(len(proto1_read))
 		case <-pending_es_proto1.valueReq:
@@ -249,25 +766,54 @@ func trackProto1(indexer *elastigo.BulkIndexer, index_name string) {
 	}
 }
 
-func trackProto2(indexer *elastigo.BulkIndexer, index_name string) {
+func trackProto2(indexer Indexer, targets []esTarget) {
 	seenEs := make(map[string]bool)    // for ES. seen once = never need to resubmit
 	seenStats := make(map[string]bool) // for stats, provides "how many recently seen?"
+	tooBig := make(map[string]bool)    // skipped because of elasticsearch.max_doc_bytes, no need to check again
+	var lastTooBigLog time.Time
+	sampleEvery := 1 // we index 1 in this many new metrics. more than 1 while shedding load, see shedRate
+	newSeen := 0
 	for {
 		select {
-		case metric := <-proto2_read:
+		case metric, ok := <-proto2_read:
+			if !ok {
+				return
+			}
 			seenStats[metric.Id] = true
-			if _, ok := seenEs[metric.Id]; ok {
+			if seenEs[metric.Id] || tooBig[metric.Id] {
+				continue
+			}
+			if *es_shed_high_water > 0 {
+				sampleEvery = shedRate(sampleEvery, len(proto2_read))
+				es_sample_every.Update(int64(sampleEvery))
+				newSeen++
+				// not marking it as seen, so it gets indexed when it comes by again after we've recovered
+				if newSeen%sampleEvery != 0 {
+					es_shed_total.Inc(1)
+					continue
+				}
+			}
+			date := clock()
+			metric_es := esDoc(metric.MetricSpec)
+			if size, ok := docFits(metric_es); !ok {
+				es_docs_too_big_total.Inc(1)
+				tooBig[metric.Id] = true
+				if time.Since(lastTooBigLog) >= time.Minute {
+					lastTooBigLog = time.Now()
+					fmt.Printf("WARN not indexing %s: its document of %d bytes exceeds elasticsearch.max_doc_bytes\n", metric.Id, size)
+				}
 				continue
 			}
-			date := time.Now()
-			refresh := false // we can wait until the regular indexing runs
-			metric_es := m20.NewMetricEs(metric)
-			err := indexer.Index(index_name, "metric", metric.Id, "", &date, &metric_es, refresh)
-			dieIfError(err)
+			pre := es_index_timer.Start()
+			indexEs(indexer, targets, metric.Id, &date, metric_es, esRoute(metric.Tags))
+			es_index_timer.Stop(pre)
 			seenEs[metric.Id] = true
+			notifyNewMetric(metric, date)
 		case <-num_seen_proto2.valueReq:
 			num_seen_proto2.valueResp <- int64(len(seenStats))
 			seenStats = make(map[string]bool)
+		case <-num_indexed_proto2.valueReq:
+			num_indexed_proto2.valueResp <- int64(len(seenEs))
 		case <-pending_backlog_proto2.valueReq:
 			pending_backlog_proto2.valueResp <- int64(len(proto2_read))
 		case <-pending_es_proto2.valueReq:
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockConn is a connection that reads the given data, and then fails with err
+type mockConn struct {
+	data   *bytes.Reader
+	err    error
+	closed bool
+}
+
+func newMockConn(data string, err error) *mockConn {
+	return &mockConn{data: bytes.NewReader([]byte(data)), err: err}
+}
+
+func (c *mockConn) Read(b []byte) (int, error) {
+	if c.data.Len() > 0 {
+		return c.data.Read(b)
+	}
+	return 0, c.err
+}
+
+func (c *mockConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *mockConn) Close() error                       { c.closed = true; return nil }
+func (c *mockConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2003} }
+func (c *mockConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000} }
+func (c *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (c *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// netError is a net.Error, like the ones reads fail with
+type netError struct {
+	timeout bool
+}
+
+func (e netError) Error() string   { return "i/o error" }
+func (e netError) Timeout() bool   { return e.timeout }
+func (e netError) Temporary() bool { return e.timeout }
+
+func TestHandleClientCountsReadErrors(t *testing.T) {
+	cases := []struct {
+		err     error
+		timeout int64
+		broken  int64
+	}{
+		{io.EOF, 0, 0},
+		{netError{timeout: true}, 1, 0},
+		{netError{timeout: false}, 0, 1},
+		{errors.New("connection reset by peer"), 0, 1},
+	}
+	for _, framing := range []string{"newline", "length_prefixed"} {
+		restore := setString(in_framing, framing)
+		for _, c := range cases {
+			timeouts, broken := in_conns_timeout_total.val.Count(), in_conns_broken_total.val.Count()
+			conn := newMockConn("", c.err)
+			handleClient(conn, protoAuto)
+			if !conn.closed {
+				t.Errorf("%s, %v: connection was not closed", framing, c.err)
+			}
+			if n := in_conns_timeout_total.val.Count() - timeouts; n != c.timeout {
+				t.Errorf("%s, %v: expected %d timeouts, got %d", framing, c.err, c.timeout, n)
+			}
+			if n := in_conns_broken_total.val.Count() - broken; n != c.broken {
+				t.Errorf("%s, %v: expected %d broken connections, got %d", framing, c.err, c.broken, n)
+			}
+		}
+		restore()
+	}
+}
+
+func TestCheckLineRejectsLongFields(t *testing.T) {
+	long := strings.Repeat("1", 10*1024)
+	cases := []struct {
+		line string
+		ok   bool
+	}{
+		{"foo.bar 123.456 1400000000\n", true},
+		{"foo.bar " + strings.Repeat("1", 64) + " 1400000000\n", true},
+		{"foo.bar " + long + " 1400000000\n", false},
+		{"foo.bar 1." + long + " 1400000000\n", false},
+		{"foo.bar 1 " + long + "\n", false},
+	}
+	for _, c := range cases {
+		_, err := checkLine([]byte(c.line))
+		if c.ok {
+			if err != nil {
+				t.Errorf("%.40s: unexpected error %q", c.line, err)
+			}
+			continue
+		}
+		r, ok := err.(rejection)
+		if !ok || r.reason != &in_lines_field_too_long_total {
+			t.Errorf("%.40s: expected a field too long rejection, got %v", c.line, err)
+		}
+		// the message quotes the line, but not all of it
+		if err != nil && len(err.Error()) > 200 {
+			t.Errorf("%.40s: error message is %d bytes", c.line, len(err.Error()))
+		}
+	}
+}
+
+func TestCheckStatsAsProto2(t *testing.T) {
+	cases := []struct {
+		proto   int
+		framing string
+		tls     bool
+		ok      bool
+	}{
+		{protoAuto, "newline", false, true},
+		{proto2, "newline", false, true},
+		{proto1, "newline", false, false},
+		{protoAuto, "length_prefixed", false, false},
+		{protoAuto, "newline", true, false},
+	}
+	for _, c := range cases {
+		err := checkStatsAsProto2(c.proto, c.framing, c.tls)
+		if (err == nil) != c.ok {
+			t.Errorf("proto %d, framing %s, tls %v: expected ok to be %v, got error %v", c.proto, c.framing, c.tls, c.ok, err)
+		}
+	}
+}
+
+// processLines runs the lines through processInputLines, and returns what it queued for indexing
+func processLines(lines ...inLine) ([]string, []trackedMetric) {
+	lines_read = make(chan inLine, len(lines))
+	proto1_read = make(chan string, len(lines))
+	proto2_read = make(chan trackedMetric, len(lines))
+	for _, l := range lines {
+		lines_read <- l
+	}
+	close(lines_read)
+	processInputLines()
+	close(proto1_read)
+	close(proto2_read)
+	var p1 []string
+	for id := range proto1_read {
+		p1 = append(p1, id)
+	}
+	var p2 []trackedMetric
+	for metric := range proto2_read {
+		p2 = append(p2, metric)
+	}
+	lines_read, proto1_read, proto2_read = nil, nil, nil
+	return p1, p2
+}
+
+func TestParseProtoHint(t *testing.T) {
+	cases := []struct {
+		hint  string
+		proto int
+		ok    bool
+	}{
+		{"auto", protoAuto, true},
+		{"1", proto1, true},
+		{"2", proto2, true},
+		{"", 0, false},
+		{"3", 0, false},
+	}
+	for _, c := range cases {
+		proto, err := parseProtoHint(c.hint)
+		if (err == nil) != c.ok || proto != c.proto {
+			t.Errorf("'%s': expected %d (ok %v), got %d, %v", c.hint, c.proto, c.ok, proto, err)
+		}
+	}
+}
+
+func TestProcessInputLinesForceProto(t *testing.T) {
+	cases := []struct {
+		hint       int
+		id         string
+		proto      int   // what it's processed as
+		proto2_bad int64 // whether we count it as a bad proto2 metric
+	}{
+		{protoAuto, "unit=B.target_type=gauge.what=foo", proto2, 0},
+		{protoAuto, "servers.web1.cpu", proto1, 0},
+		{protoAuto, "servers.web1.unit=B", proto2, 1}, // a stray unit tag gets a proto1 metric misclassified
+		{protoAuto, "servers.web1.a=b", proto1, 0},
+		{proto1, "servers.web1.a=b", proto1, 0},
+		{proto1, "unit=B.target_type=gauge.what=foo", proto1, 0},
+		{proto2, "unit=B.target_type=gauge.what=foo", proto2, 0},
+		{proto2, "servers.web1.cpu", proto2, 1}, // no tags, so it's a bad proto2 metric
+	}
+	for _, c := range cases {
+		bad := in_metrics_proto2_bad_total.val.Count()
+		p1, p2 := processLines(inLine{buf: []byte(c.id + " 1 1400000000\n"), proto: c.hint})
+		if n := in_metrics_proto2_bad_total.val.Count() - bad; n != c.proto2_bad {
+			t.Errorf("hint %d, %s: expected %d bad proto2 metrics, got %d", c.hint, c.id, c.proto2_bad, n)
+		}
+		if c.proto == proto1 && (len(p1) != 1 || len(p2) != 0) {
+			t.Errorf("hint %d, %s: expected it to be indexed as proto1, got %v and %v", c.hint, c.id, p1, p2)
+		}
+		if c.proto == proto2 && (len(p1) != 0 || len(p2) != 1-int(c.proto2_bad)) {
+			t.Errorf("hint %d, %s: expected it to be processed as proto2, got %v and %v", c.hint, c.id, p1, p2)
+		}
+	}
+}
+
+// withTestDestination makes processInputLines forward to a single destination, which is returned
+func withTestDestination() (*destination, func()) {
+	dest := testDestination("test")
+	old := destinations
+	destinations = []*destination{dest}
+	return dest, func() { destinations = old }
+}
+
+// forwarded returns the lines queued for the destination
+func forwarded(dest *destination) []string {
+	var lines []string
+	for len(dest.lines) > 0 {
+		lines = append(lines, string(<-dest.lines))
+	}
+	return lines
+}
+
+func TestProcessInputLinesMetadataOnly(t *testing.T) {
+	dest, restore := withTestDestination()
+	defer restore()
+	cases := []struct {
+		line     string
+		enabled  bool
+		indexed  int
+		fwd      int
+		metadata int64
+	}{
+		{"unit=B.target_type=gauge.what=foo 1 1400000000", false, 1, 1, 0},
+		{"unit=B.target_type=gauge.what=foo 1 1400000000", true, 1, 1, 0},
+		{"unit=B.target_type=gauge.what=foo", false, 0, 0, 0},
+		{"unit=B.target_type=gauge.what=foo", true, 1, 0, 1},
+		{"servers.web1.cpu", true, 1, 0, 1},
+		{"unit=B.target_type=gauge.what=foo 1", true, 0, 0, 0},
+	}
+	for _, c := range cases {
+		restoreSetting := setBool(parse_metadata_only, c.enabled)
+		metadata, bad := in_metadata_only_total.val.Count(), in_lines_bad_total.val.Count()
+		p1, p2 := processLines(inLine{buf: []byte(c.line + "\n"), proto: protoAuto})
+		restoreSetting()
+		if len(p1)+len(p2) != c.indexed {
+			t.Errorf("%s (enabled %v): expected %d indexed, got %v and %v", c.line, c.enabled, c.indexed, p1, p2)
+		}
+		if lines := forwarded(dest); len(lines) != c.fwd {
+			t.Errorf("%s (enabled %v): expected %d forwarded, got %q", c.line, c.enabled, c.fwd, lines)
+		}
+		if n := in_metadata_only_total.val.Count() - metadata; n != c.metadata {
+			t.Errorf("%s (enabled %v): expected %d metadata only, got %d", c.line, c.enabled, c.metadata, n)
+		}
+		if n := in_lines_bad_total.val.Count() - bad; (n == 1) != (c.indexed == 0) {
+			t.Errorf("%s (enabled %v): counted %d bad lines", c.line, c.enabled, n)
+		}
+	}
+}
+
+func TestHandleClientUnterminatedLine(t *testing.T) {
+	cases := []struct {
+		data     string
+		err      error
+		keep     bool
+		lines    []string
+		partials int64
+	}{
+		{"foo=1.unit=B 1 123\n", io.EOF, false, []string{"foo=1.unit=B 1 123\n"}, 0},
+		{"foo=1.unit=B 1 123", io.EOF, false, nil, 1},
+		{"foo=1.unit=B 1 123", io.EOF, true, []string{"foo=1.unit=B 1 123\n"}, 1},
+		// after a broken connection, we can't tell whether the line is complete
+		{"foo=1.unit=B 1 123", netError{timeout: false}, true, nil, 1},
+		{"foo.bar 1 123\nfoo=1.unit=B 1 123", io.EOF, true, []string{"foo.bar 1 123\n", "foo=1.unit=B 1 123\n"}, 1},
+		{"foo.bar 1 123\n  ", io.EOF, true, []string{"foo.bar 1 123\n"}, 0},
+	}
+	for _, c := range cases {
+		restore := setBool(in_keep_partial, c.keep)
+		partials := in_conns_unterminated_total.val.Count()
+		lines_read = make(chan inLine, 10)
+		handleClient(newMockConn(c.data, c.err), protoAuto)
+		close(lines_read)
+		restore()
+		var lines []string
+		for l := range lines_read {
+			lines = append(lines, string(l.buf))
+		}
+		lines_read = nil
+		if strings.Join(lines, "") != strings.Join(c.lines, "") {
+			t.Errorf("%q, %v (keep %v): expected lines %q, got %q", c.data, c.err, c.keep, c.lines, lines)
+		}
+		if n := in_conns_unterminated_total.val.Count() - partials; n != c.partials {
+			t.Errorf("%q, %v (keep %v): expected %d unterminated, got %d", c.data, c.err, c.keep, c.partials, n)
+		}
+	}
+}
+
+func TestProcessInputLinesTagsPerMetric(t *testing.T) {
+	defer func(old metrics.Histogram) { tags_per_metric = old }(tags_per_metric)
+	tags_per_metric = metrics.NewHistogram(metrics.NewUniformSample(100))
+	processLines(
+		inLine{buf: []byte("unit=B.target_type=gauge.what=foo 1 1400000000\n"), proto: protoAuto},
+		inLine{buf: []byte("unit=B.target_type=gauge.what=foo.host=web1.dc=ams 1 1400000000\n"), proto: protoAuto},
+		inLine{buf: []byte("unit=B.what=foo.host=web1.dc=ams.a=b.c=d.e=f 1 1400000000\n"), proto: protoAuto}, // invalid: no target_type
+		inLine{buf: []byte("servers.web1.cpu 1 1400000000\n"), proto: protoAuto},
+	)
+	h := tags_per_metric.Snapshot()
+	if h.Count() != 2 || h.Min() != 3 || h.Max() != 5 {
+		t.Errorf("expected 2 metrics with 3 and 5 tags, got %d with min %d and max %d", h.Count(), h.Min(), h.Max())
+	}
+}
+
+func TestTeeRawForwardsInputAsIs(t *testing.T) {
+	dest, restore := withTestDestination()
+	defer restore()
+	defer setBool(out_tee_raw, true)()
+	// all of which would change the forwarded lines without out.tee_raw
+	defer setBool(parse_trim_empty_nodes, true)()
+	defer setString(parse_timestamp_unit, "auto")()
+	input := "foo.bar 1 1400000000\n" +
+		"unit=B..what=foo.target_type=gauge 2 1400000000123\n" +
+		"garbage\n" +
+		"\n" +
+		"foo.crlf 3 1400000000\r\n" +
+		"unit=B.what=bar.target_type=gauge 2 1400000000 \n"
+
+	lines_read = make(chan inLine, 100)
+	handleClient(newMockConn(input, io.EOF), protoAuto)
+	close(lines_read)
+	var lines []inLine
+	for l := range lines_read {
+		lines = append(lines, l)
+	}
+	// the copy still gets processed, but not forwarded
+	_, p2 := processLines(lines...)
+	if len(p2) != 2 {
+		t.Errorf("expected 2 proto2 metrics to be indexed, got %v", p2)
+	}
+	if fwd := strings.Join(forwarded(dest), ""); fwd != input {
+		t.Errorf("expected to forward the input as is:\n%q\ngot:\n%q", input, fwd)
+	}
+}
+
+func TestReceivedSplitsRecords(t *testing.T) {
+	dest, restore := withTestDestination()
+	defer restore()
+	defer setString(in_line_splitter, ";")()
+	lines := []string{
+		"a.b 1 1400000000;unit=B.target_type=gauge.what=foo 2 1400000000\n",
+		"a.c 3 1400000000;\r\n", // a trailing delimiter
+	}
+	for _, tee := range []bool{false, true} {
+		restoreTee := setBool(out_tee_raw, tee)
+		empty := in_records_empty_total.val.Count()
+		lines_read = make(chan inLine, 10)
+		for _, line := range lines {
+			received(inLine{buf: []byte(line), proto: protoAuto, source: "10.0.0.1:50000"})
+		}
+		close(lines_read)
+		var records []inLine
+		for l := range lines_read {
+			if l.source != "10.0.0.1:50000" {
+				t.Errorf("tee_raw %v: record %q lost its source", tee, l.buf)
+			}
+			records = append(records, l)
+		}
+		if n := in_records_empty_total.val.Count() - empty; n != 1 {
+			t.Errorf("tee_raw %v: expected 1 empty record, got %d", tee, n)
+		}
+		// every record is processed as a line of its own
+		p1, p2 := processLines(records...)
+		if len(p1) != 2 || len(p2) != 1 {
+			t.Errorf("tee_raw %v: expected 2 proto1 and 1 proto2 metric, got %v and %v", tee, p1, p2)
+		}
+		expected := "a.b 1 1400000000\nunit=B.target_type=gauge.what=foo 2 1400000000\na.c 3 1400000000\n"
+		if tee {
+			expected = strings.Join(lines, "")
+		}
+		if fwd := strings.Join(forwarded(dest), ""); fwd != expected {
+			t.Errorf("tee_raw %v: expected to forward %q, got %q", tee, expected, fwd)
+		}
+		restoreTee()
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/pelletier/go-toml"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/stvp/go-toml-config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the config can be split over multiple files: -config is loaded first, followed by the .conf files in -config-dir,
+// in lexical order, so operators can e.g. have 10-listen.conf, 20-parse.conf and 30-es.conf managed by different teams.
+// when several files set the same key, the one loaded last wins.
+// on top of that, every key can be set through the environment: CARBON_TAGGER_<SECTION>_<KEY>, in upper case,
+// e.g. CARBON_TAGGER_ELASTICSEARCH_HOST for elasticsearch.host, or CARBON_TAGGER_IN_MAX_FRAME_LEN for in.max_frame_len.
+// (section names don't have underscores, so that's unambiguous. ES is short for ELASTICSEARCH)
+// the environment wins over all files.
+
+// configFiles returns the config files to load, in the order to load them in
+func configFiles() ([]string, error) {
+	files := []string{*configFile}
+	if *configDir == "" {
+		return files, nil
+	}
+	info, err := os.Stat(*configDir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read -config-dir: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("-config-dir %s is not a directory", *configDir)
+	}
+	// Glob returns the matches sorted
+	matches, err := filepath.Glob(filepath.Join(*configDir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+	return append(files, matches...), nil
+}
+
+const envPrefix = "CARBON_TAGGER_"
+
+// envConfig returns the settings from the environment as a TOML document, or "" if there are none
+func envConfig() (string, error) {
+	sections := make(map[string][]string)
+	var names []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		parts := strings.SplitN(strings.ToLower(pair[0][len(envPrefix):]), "_", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return "", fmt.Errorf("environment variable %s should be of the form %s<SECTION>_<KEY>", pair[0], envPrefix)
+		}
+		section := parts[0]
+		if section == "es" {
+			section = "elasticsearch"
+		}
+		if _, ok := sections[section]; !ok {
+			names = append(names, section)
+		}
+		sections[section] = append(sections[section], fmt.Sprintf("%s = %s", parts[1], tomlValue(pair[1])))
+	}
+	// os.Environ isn't ordered, but we like to be predictable
+	sort.Strings(names)
+	var doc bytes.Buffer
+	for _, section := range names {
+		sort.Strings(sections[section])
+		fmt.Fprintf(&doc, "[%s]\n%s\n", section, strings.Join(sections[section], "\n"))
+	}
+	return doc.String(), nil
+}
+
+// tomlValue returns the TOML for a setting from the environment. we don't know the types of the settings here,
+// so integers and booleans are written as such, and everything else as strings.
+// (the config variables are set from strings anyway, this just matters for the settings we reload)
+func tomlValue(value string) string {
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return value
+	}
+	if value == "true" || value == "false" {
+		return value
+	}
+	escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t", "\r", "\\r").Replace(value)
+	return "\"" + escaped + "\""
+}
+
+// parseConfig loads all config files, and then the environment, into the config variables
+func parseConfig() error {
+	files, err := configFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = config.Parse(file)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+	env, err := envConfig()
+	if err != nil || env == "" {
+		return err
+	}
+	// the config package only reads files
+	f, err := ioutil.TempFile("", "carbon-tagger-env")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(env)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	err = config.Parse(f.Name())
+	if err != nil {
+		return fmt.Errorf("environment: %s", err.Error())
+	}
+	return nil
+}
+
+// configTrees is the config as read straight from all config files and the environment, for reloading settings at runtime
+type configTrees []*toml.TomlTree
+
+func loadConfigTrees() (configTrees, error) {
+	files, err := configFiles()
+	if err != nil {
+		return nil, err
+	}
+	trees := make(configTrees, len(files))
+	for i, file := range files {
+		trees[i], err = toml.LoadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+	env, err := envConfig()
+	if err != nil || env == "" {
+		return trees, err
+	}
+	tree, err := toml.Load(env)
+	if err != nil {
+		return nil, fmt.Errorf("environment: %s", err.Error())
+	}
+	return append(trees, tree), nil
+}
+
+// GetDefault returns the value for the key from the last file that has it, or def if none do
+func (trees configTrees) GetDefault(key string, def interface{}) interface{} {
+	for i := len(trees) - 1; i >= 0; i-- {
+		if value := trees[i].Get(key); value != nil {
+			return value
+		}
+	}
+	return def
+}
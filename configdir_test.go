@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigs writes the files (name -> content) into a fresh directory, and returns it
+func writeConfigs(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "carbon-tagger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestConfigDirPrecedence(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"main.conf":          "[in]\nport = 2003\ndrain_period = 30\n[stats]\nhost = \"main\"\n",
+		"conf.d/20-b.conf":   "[in]\nport = 2005\n",
+		"conf.d/10-a.conf":   "[in]\nport = 2004\ndrain_period = 40\n",
+		"conf.d/30-c.txt":    "[in]\nport = 2006\n", // not a .conf file
+		"conf.d/05-ips.conf": "[in]\nip_blocklist = \"10.0.0.1\"\n",
+	})
+	defer os.RemoveAll(dir)
+	defer setString(configFile, filepath.Join(dir, "main.conf"))()
+	defer setString(configDir, filepath.Join(dir, "conf.d"))()
+
+	files, err := configFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"main.conf", "conf.d/05-ips.conf", "conf.d/10-a.conf", "conf.d/20-b.conf"}
+	if len(files) != len(expected) {
+		t.Fatalf("expected files %v, got %v", expected, files)
+	}
+	for i := range files {
+		if files[i] != filepath.Join(dir, expected[i]) {
+			t.Errorf("file %d: expected %s, got %s", i, expected[i], files[i])
+		}
+	}
+
+	// the last file that has a key wins
+	trees, err := loadConfigTrees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := trees.GetDefault("in.port", int64(0)); port != int64(2005) {
+		t.Errorf("expected in.port 2005, got %v", port)
+	}
+	if period := trees.GetDefault("in.drain_period", int64(0)); period != int64(40) {
+		t.Errorf("expected in.drain_period 40, got %v", period)
+	}
+	if host := trees.GetDefault("stats.host", ""); host != "main" {
+		t.Errorf("expected stats.host main, got %v", host)
+	}
+	if list := trees.GetDefault("in.ip_allowlist", "none"); list != "none" {
+		t.Errorf("expected the default for in.ip_allowlist, got %v", list)
+	}
+
+	// and the same goes for the config variables
+	defer setInt(in_port, *in_port)()
+	defer setInt(in_drain_period, *in_drain_period)()
+	defer setString(stats_host, *stats_host)()
+	defer setString(in_ip_blocklist, *in_ip_blocklist)()
+	err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *in_port != 2005 || *in_drain_period != 40 || *stats_host != "main" || *in_ip_blocklist != "10.0.0.1" {
+		t.Errorf("unexpected config in.port %d, in.drain_period %d, stats.host %s, in.ip_blocklist %s", *in_port, *in_drain_period, *stats_host, *in_ip_blocklist)
+	}
+}
+
+func TestConfigDirErrors(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"main.conf":        "[in]\nport = 2003\n",
+		"notadir":          "",
+		"broken/10-a.conf": "[in\nport = 2004\n",
+	})
+	defer os.RemoveAll(dir)
+	defer setString(configFile, filepath.Join(dir, "main.conf"))()
+	defer setString(configDir, "")()
+
+	for _, d := range []string{"missing", "notadir"} {
+		*configDir = filepath.Join(dir, d)
+		if _, err := configFiles(); err == nil {
+			t.Errorf("-config-dir %s: expected an error", d)
+		}
+		if _, err := loadConfigTrees(); err == nil {
+			t.Errorf("-config-dir %s: expected an error reloading", d)
+		}
+	}
+
+	*configDir = filepath.Join(dir, "broken")
+	if _, err := loadConfigTrees(); err == nil {
+		t.Errorf("expected an error for a file that isn't valid TOML")
+	}
+
+	*configDir = ""
+	*configFile = filepath.Join(dir, "missing.conf")
+	if _, err := loadConfigTrees(); err == nil {
+		t.Errorf("expected an error for a missing -config")
+	}
+}
+
+// setEnv sets the environment variable, for use like defer setEnv(key, value)()
+func setEnv(key, value string) func() {
+	os.Setenv(key, value)
+	return func() { os.Unsetenv(key) }
+}
+
+func TestEnvConfigPrecedence(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"main.conf": "[in]\nport = 2003\ndrain_period = 30\n[elasticsearch]\nhost = \"es-file\"\n[out]\ngzip = false\n[parse]\ndefault_unit = \"file\"\n",
+	})
+	defer os.RemoveAll(dir)
+	defer setString(configFile, filepath.Join(dir, "main.conf"))()
+	defer setString(configDir, "")()
+	defer setEnv("CARBON_TAGGER_IN_PORT", "2010")()
+	defer setEnv("CARBON_TAGGER_ES_HOST", "es-env")()
+	defer setEnv("CARBON_TAGGER_OUT_GZIP", "true")()
+	defer setEnv("CARBON_TAGGER_PARSE_DEFAULT_UNIT", `un"known`)()
+
+	defer setInt(in_port, *in_port)()
+	defer setInt(in_drain_period, *in_drain_period)()
+	defer setString(es_host, *es_host)()
+	defer setBool(out_gzip, *out_gzip)()
+	defer setString(parse_default_unit, *parse_default_unit)()
+	err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the environment wins, and what it doesn't set comes from the file
+	if *in_port != 2010 || *es_host != "es-env" || !*out_gzip || *parse_default_unit != `un"known` || *in_drain_period != 30 {
+		t.Errorf("unexpected config in.port %d, elasticsearch.host %s, out.gzip %v, parse.default_unit %s, in.drain_period %d",
+			*in_port, *es_host, *out_gzip, *parse_default_unit, *in_drain_period)
+	}
+
+	// and the same goes for what we reload at runtime
+	trees, err := loadConfigTrees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port := trees.GetDefault("in.port", int64(0)); port != int64(2010) {
+		t.Errorf("expected in.port 2010, got %v", port)
+	}
+	if period := trees.GetDefault("in.drain_period", int64(0)); period != int64(30) {
+		t.Errorf("expected in.drain_period 30, got %v", period)
+	}
+	if host := trees.GetDefault("elasticsearch.host", ""); host != "es-env" {
+		t.Errorf("expected elasticsearch.host es-env, got %v", host)
+	}
+}
+
+func TestEnvConfigInvalid(t *testing.T) {
+	for _, key := range []string{"CARBON_TAGGER_PORT", "CARBON_TAGGER_IN_"} {
+		restore := setEnv(key, "2010")
+		if _, err := envConfig(); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+		restore()
+	}
+}
+
+func TestTomlValue(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"2003", "2003"},
+		{"-1", "-1"},
+		{"true", "true"},
+		{"false", "false"},
+		{"", `""`},
+		{"es.local", `"es.local"`},
+		{"1.5", `"1.5"`}, // our config has no floats
+		{"True", `"True"`},
+		{`a "quoted" \ value`, `"a \"quoted\" \\ value"`},
+		{"two\nlines", `"two\nlines"`},
+	}
+	for _, c := range cases {
+		if value := tomlValue(c.value); value != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.value, c.expected, value)
+		}
+	}
+}
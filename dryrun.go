@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	m20 "github.com/metrics20/go-metrics20"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// POST /parse on the stats http address takes a line in the body, and tells whether we'd accept it, and how we'd index it,
+// without indexing or forwarding anything. it goes through the same checks as lines from our listener (with its
+// in.force_proto), so senders can try out their metric format against the running config.
+// with in.line_splitter, the line is split into records like the listener's lines are, and there's a result per record.
+
+const maxParseBody = 64 * 1024
+
+type parseResult struct {
+	Proto        string            `json:"proto,omitempty"` // "1" or "2". empty if the line was rejected before we looked at the metric id
+	Accepted     bool              `json:"accepted"`
+	Reason       string            `json:"reason,omitempty"`
+	Id           string            `json:"id,omitempty"` // the metric id as we'd index and forward it
+	Tags         map[string]string `json:"tags,omitempty"`
+	MetadataOnly bool              `json:"metadata_only,omitempty"`
+}
+
+// dryRunLine tells what we'd do with a line from a client: a result per record with in.line_splitter, otherwise just one.
+func dryRunLine(buf []byte, hint int) []parseResult {
+	if *in_line_splitter == "" {
+		return []parseResult{dryRun(buf, hint)}
+	}
+	records, _ := splitRecords(buf, *in_line_splitter)
+	var results []parseResult
+	for _, rec := range records {
+		results = append(results, dryRun(rec, hint))
+	}
+	return results
+}
+
+func dryRun(buf []byte, hint int) parseResult {
+	l, err := checkLine(buf)
+	if err != nil {
+		return parseResult{Reason: err.Error()}
+	}
+	res := parseResult{MetadataOnly: l.metadataOnly}
+	id := transformId(l.elements[0])
+	if isProto2Line(hint, id) {
+		res.Proto = "2"
+		metric, _, err := parseTagBasedMetric(id)
+		if err != nil {
+			res.Reason = err.Error()
+			return res
+		}
+		res.Accepted, res.Id, res.Tags = true, metric.Id, metric.Tags
+		return res
+	}
+	res.Proto = "1"
+	err = m20.InitialValidation(id, m20.Legacy)
+	if err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	res.Accepted, res.Id = true, id
+	return res
+}
+
+func parseHandler(hint int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxParseBody))
+		if err != nil {
+			http.Error(w, "could not read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		line := strings.TrimSpace(string(body))
+		if line == "" || strings.Contains(line, "\n") {
+			http.Error(w, "send exactly one line", http.StatusBadRequest)
+			return
+		}
+		results := dryRunLine([]byte(line+"\n"), hint)
+		if len(results) == 0 {
+			http.Error(w, "the line has only empty records", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if *in_line_splitter == "" {
+			json.NewEncoder(w).Encode(results[0])
+			return
+		}
+		json.NewEncoder(w).Encode(results)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	cases := []struct {
+		hint     int
+		line     string
+		expected parseResult
+	}{
+		{protoAuto, "unit=Errps.target_type=rate.what=errors 1 1400000000\n", parseResult{
+			Proto:    "2",
+			Accepted: true,
+			Id:       "unit=Errps.target_type=rate.what=errors",
+			Tags:     map[string]string{"unit": "Err/s", "target_type": "rate", "what": "errors"},
+		}},
+		{protoAuto, "foo.bar 1 1400000000\n", parseResult{Proto: "1", Accepted: true, Id: "foo.bar"}},
+		// the listener's in.force_proto applies
+		{proto2, "foo.bar 1 1400000000\n", parseResult{Proto: "2"}},
+	}
+	for _, c := range cases {
+		res := dryRun([]byte(c.line), c.hint)
+		if c.expected.Accepted {
+			if !reflect.DeepEqual(res, c.expected) {
+				t.Errorf("%q: expected %+v, got %+v", c.line, c.expected, res)
+			}
+			continue
+		}
+		if res.Accepted || res.Proto != c.expected.Proto || res.Reason == "" {
+			t.Errorf("%q: expected to be rejected as proto %s with a reason, got %+v", c.line, c.expected.Proto, res)
+		}
+	}
+
+	// invalid proto2: the rejection tells why
+	defer setBool(parse_trim_empty_nodes, false)()
+	res := dryRun([]byte("unit=B..target_type=gauge.what=foo 1 1400000000\n"), protoAuto)
+	if res.Accepted || res.Proto != "2" || !strings.Contains(res.Reason, "empty") {
+		t.Errorf("expected an invalid proto2 metric with empty nodes, got %+v", res)
+	}
+	// lines we reject before looking at the metric id have no proto
+	res = dryRun([]byte("foo.bar 1\n"), protoAuto)
+	if res.Accepted || res.Proto != "" || res.Reason == "" {
+		t.Errorf("expected a line with 2 fields to be rejected, got %+v", res)
+	}
+}
+
+func TestParseHandler(t *testing.T) {
+	handler := parseHandler(protoAuto)
+	cases := []struct {
+		method string
+		body   string
+		status int
+		proto  string
+		ok     bool
+	}{
+		{"POST", "unit=B.target_type=gauge.what=foo 1 1400000000", http.StatusOK, "2", true},
+		{"POST", "  unit=B.target_type=gauge.what=foo 1 1400000000\n", http.StatusOK, "2", true},
+		{"POST", "unit=B.what=foo 1 1400000000", http.StatusOK, "2", false}, // no target_type
+		{"POST", "foo.bar 1 1400000000", http.StatusOK, "1", true},
+		{"POST", "", http.StatusBadRequest, "", false},
+		{"POST", "foo.bar 1 1400000000\nfoo.baz 1 1400000000", http.StatusBadRequest, "", false},
+		{"POST", strings.Repeat("x", maxParseBody+1), http.StatusBadRequest, "", false},
+		{"GET", "foo.bar 1 1400000000", http.StatusMethodNotAllowed, "", false},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(c.method, "/parse", strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Errorf("%s %.50q: expected status %d, got %d", c.method, c.body, c.status, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var res parseResult
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Errorf("%.50q: invalid json %q: %s", c.body, w.Body.String(), err)
+			continue
+		}
+		if res.Proto != c.proto || res.Accepted != c.ok {
+			t.Errorf("%.50q: expected proto %s, accepted %v, got %+v", c.body, c.proto, c.ok, res)
+		}
+	}
+}
+
+func TestParseHandlerLineSplitter(t *testing.T) {
+	defer setString(in_line_splitter, ";")()
+	handler := parseHandler(protoAuto)
+	cases := []struct {
+		body     string
+		status   int
+		expected []parseResult // just the proto and whether it's accepted
+	}{
+		{"unit=B.target_type=gauge.what=foo 1 1400000000;foo.bar 1 1400000000;unit=B.what=foo 1 1400000000;", http.StatusOK,
+			[]parseResult{{Proto: "2", Accepted: true}, {Proto: "1", Accepted: true}, {Proto: "2"}}},
+		{"foo.bar 1 1400000000", http.StatusOK, []parseResult{{Proto: "1", Accepted: true}}},
+		{"foo.bar 1;foo.baz 1 1400000000", http.StatusOK, []parseResult{{}, {Proto: "1", Accepted: true}}},
+		{";;", http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/parse", strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Errorf("%.50q: expected status %d, got %d", c.body, c.status, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var res []parseResult
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Errorf("%.50q: invalid json %q: %s", c.body, w.Body.String(), err)
+			continue
+		}
+		if len(res) != len(c.expected) {
+			t.Errorf("%.50q: expected %d results, got %+v", c.body, len(c.expected), res)
+			continue
+		}
+		for i, r := range res {
+			if r.Proto != c.expected[i].Proto || r.Accepted != c.expected[i].Accepted {
+				t.Errorf("%.50q: record %d: expected proto %s, accepted %v, got %+v", c.body, i, c.expected[i].Proto, c.expected[i].Accepted, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"net"
+	"strings"
+	"time"
+)
+
+// Indexer is what we need from an ES indexer. *elastigo.BulkIndexer satisfies it as is,
+// coding against this rather than elastigo makes it easy to swap in something else.
+type Indexer interface {
+	Index(index string, _type string, id, ttl string, date *time.Time, data interface{}, refresh bool) error
+	UpdateWithPartialDoc(index string, _type string, id, ttl string, date *time.Time, partialDoc interface{}, upsert bool, refresh bool) error
+	PendingDocuments() int
+	NumErrors() uint64
+}
+
+// esTarget is an index (or an alias pointing to one) that metric documents get written into.
+// the primary target is required to work. a secondary target is only written to during a
+// migration window, so failures there don't take us down, they're just counted.
+type esTarget struct {
+	name    string
+	primary bool
+	ok      stat
+	err     stat
+}
+
+func newEsTarget(name string, primary bool) esTarget {
+	role := "secondary"
+	if primary {
+		role = "primary"
+	}
+	return esTarget{
+		name:    name,
+		primary: primary,
+		ok:      NewCounter(fmt.Sprintf("unit_is_Metric.direction_is_out.type_is_indexed.target_is_%s", role), false),
+		err:     NewCounter(fmt.Sprintf("unit_is_Err.orig_unit_is_Metric.type_is_index_failed.target_is_%s", role), false),
+	}
+}
+
+// esTargets returns the targets to write to based on the elasticsearch config
+func esTargets() []esTarget {
+	primary := *es_index_name
+	if *es_alias != "" {
+		primary = *es_alias
+	}
+	targets := []esTarget{newEsTarget(primary, true)}
+	if *es_secondary_index != "" {
+		targets = append(targets, newEsTarget(*es_secondary_index, false))
+	}
+	return targets
+}
+
+// indexEs submits the document for the given id to all targets.
+// with elasticsearch.upsert, we merge our fields into the document if it already exists
+// (e.g. we've restarted and forgot we've seen it), instead of replacing it,
+// so that fields added to it by other tools are preserved.
+// route is the suffix of the index for per-tenant indices (see esRoute), or empty for the default index
+func indexEs(indexer Indexer, targets []esTarget, id string, date *time.Time, doc interface{}, route string) {
+	refresh := false // we can wait until the regular indexing runs
+	for _, t := range targets {
+		index := t.name
+		if route != "" {
+			index += "_" + route
+		}
+		var err error
+		if *es_upsert {
+			err = indexer.UpdateWithPartialDoc(index, "metric", id, "", date, doc, true, refresh)
+		} else {
+			err = indexer.Index(index, "metric", id, "", date, doc, refresh)
+		}
+		if err != nil {
+			t.err.Inc(1)
+			if t.primary {
+				dieIfError(err)
+			}
+			fmt.Printf("WARN could not index %s into secondary index %s: %s\n", id, index, err.Error())
+			continue
+		}
+		t.ok.Inc(1)
+	}
+}
+
+// esDoc returns the document to index for a metric, in the shape set by elasticsearch.tag_layout. for tags unit=B and what=foo:
+// * kv_list (the default): {"tags": ["unit=B", "what=foo"]}
+// * nested: {"tags": {"unit": "B", "what": "foo"}}
+// * flat: {"tag_unit": "B", "tag_what": "foo"}
+// legacy metrics have no tags, so they get an empty list or object, or an empty document.
+// with elasticsearch.derive_semantics, the document also gets a value_semantics field, see valueSemantics.
+func esDoc(spec m20.MetricSpec) interface{} {
+	semantics := ""
+	if *es_derive_semantics {
+		semantics = valueSemantics(spec.Tags)
+	}
+	switch *es_tag_layout {
+	case "nested":
+		tags := spec.Tags
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		doc := map[string]interface{}{"tags": tags}
+		if semantics != "" {
+			doc["value_semantics"] = semantics
+		}
+		return doc
+	case "flat":
+		doc := make(map[string]string, len(spec.Tags)+1)
+		for key, value := range spec.Tags {
+			doc["tag_"+key] = value
+		}
+		if semantics != "" {
+			doc["value_semantics"] = semantics
+		}
+		return doc
+	}
+	doc := kvListDoc{m20.NewMetricEs(spec).Tags, semantics}
+	if doc.Tags == nil {
+		doc.Tags = make([]string, 0)
+	}
+	return doc
+}
+
+// kvListDoc is m20.MetricEs, plus the derived field
+type kvListDoc struct {
+	Tags           []string `json:"tags"`
+	ValueSemantics string   `json:"value_semantics,omitempty"`
+}
+
+// valueSemantics derives how a metric's values behave from its tags, so tooling can query on that:
+// * target_type gauge, count, counter, rate or timestamp: that, as is
+// * no (known) target_type, but a rate unit (one with a slash, like "Err/s", see parse.unit_rewrites): "rate"
+// * otherwise we don't know, and return "", which means the field is left out.
+func valueSemantics(tags map[string]string) string {
+	switch tags["target_type"] {
+	case "gauge", "count", "counter", "rate", "timestamp":
+		return tags["target_type"]
+	}
+	if strings.Contains(tags["unit"], "/") {
+		return "rate"
+	}
+	return ""
+}
+
+// docFits checks whether the serialized document stays within elasticsearch.max_doc_bytes, which is what
+// keeps metrics with huge amounts of tags from getting rejected by ES (which is fatal for the primary target).
+// it also returns the size, if it had to compute it.
+func docFits(doc interface{}) (int, bool) {
+	if *es_max_doc_bytes <= 0 {
+		return 0, true
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		// not our problem. let the indexer report it
+		return 0, true
+	}
+	return len(buf), len(buf) <= *es_max_doc_bytes
+}
+
+// shedRate returns 1 in how many new proto2 metrics to index, given the current rate and how many metrics are queued.
+// once the queue reaches elasticsearch.shed_high_water, indexing ES can't keep up, so we sample 1 in elasticsearch.shed_sample,
+// until the queue is down to half of the high-water mark. (the gap prevents flapping between the two)
+func shedRate(current, queued int) int {
+	if queued >= *es_shed_high_water {
+		return *es_shed_sample
+	}
+	if queued <= *es_shed_high_water/2 {
+		return 1
+	}
+	return current
+}
+
+// esRoute returns the index suffix for a metric with elasticsearch.route_by_tag: the value of that tag,
+// reduced to characters that are safe in an index name (lowercase letters, digits, '_' and '-').
+// without the tag (or without anything safe in its value), the metric goes to the default index.
+func esRoute(tags map[string]string) string {
+	if *es_route_by_tag == "" {
+		return ""
+	}
+	value := strings.ToLower(tags[*es_route_by_tag])
+	route := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			route = append(route, c)
+		}
+	}
+	return string(route)
+}
+
+// bulkMaxActions is the number of documents at which a bulk request gets sent
+func bulkMaxActions() int {
+	if *es_bulk_max_actions > 0 {
+		return *es_bulk_max_actions
+	}
+	return *es_max_pending
+}
+
+// newIndexer starts a bulk indexer for es, that sends its bulk requests at bulkMaxActions documents,
+// elasticsearch.bulk_max_bytes bytes or after elasticsearch.flush_interval, whichever comes first.
+// the requests are timed, and if inflight isn't nil, limited by it (see limitInflight)
+func newIndexer(es *elastigo.Conn, timer *sampledTimer, inflight chan bool) *elastigo.BulkIndexer {
+	indexer := es.NewBulkIndexer(4)
+	indexer.BulkMaxDocs = bulkMaxActions()
+	indexer.BulkMaxBuffer = *es_bulk_max_bytes
+	indexer.BufferDelayMax = time.Duration(*es_flush_int) * time.Second
+	indexer.Sender = timeSends(indexer.Send, timer)
+	if inflight != nil {
+		indexer.Sender = limitInflight(indexer.Sender, inflight)
+	}
+	indexer.Start()
+	return indexer
+}
+
+// limitInflight wraps the sender of an elastigo bulk indexer, so that across all indexers sharing the semaphore,
+// no more than cap(sem) bulk requests are in flight to ES at any time, regardless of how many workers they have.
+func limitInflight(send func(*bytes.Buffer) error, sem chan bool) func(*bytes.Buffer) error {
+	return func(buf *bytes.Buffer) error {
+		sem <- true
+		es_inflight.Inc(1)
+		defer func() {
+			es_inflight.Dec(1)
+			<-sem
+		}()
+		return send(buf)
+	}
+}
+
+// timeSends wraps the sender of an elastigo bulk indexer to time the bulk requests to ES,
+// and to count the ones that were abandoned because they hit elasticsearch.op_timeout
+func timeSends(send func(*bytes.Buffer) error, timer *sampledTimer) func(*bytes.Buffer) error {
+	return func(buf *bytes.Buffer) error {
+		pre := time.Now()
+		err := send(buf)
+		timer.UpdateSince(pre)
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			es_timeouts_total.Inc(1)
+		}
+		return err
+	}
+}
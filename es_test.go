@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	elastigo "github.com/vimeo/carbon-tagger/_third_party/github.com/mattbaird/elastigo/lib"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// indexed is a call to an Indexer
+type indexed struct {
+	index  string
+	id     string
+	date   time.Time
+	doc    interface{}
+	upsert bool // whether it came in through UpdateWithPartialDoc
+}
+
+// fakeIndexer is an Indexer that records what it's asked to index, instead of sending it to ES.
+// indexing into one of the indices in fail returns an error.
+// with buffer, like the bulk indexer, documents are pending until they're flushed.
+type fakeIndexer struct {
+	sync.Mutex
+	docs    []indexed
+	pending []indexed
+	fail    map[string]bool
+	buffer  bool
+}
+
+func (f *fakeIndexer) add(index, id string, date *time.Time, doc interface{}, upsert bool) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.fail[index] {
+		return errors.New("index " + index + " is down")
+	}
+	if f.buffer {
+		f.pending = append(f.pending, indexed{index, id, *date, doc, upsert})
+		return nil
+	}
+	f.docs = append(f.docs, indexed{index, id, *date, doc, upsert})
+	return nil
+}
+
+func (f *fakeIndexer) Index(index string, _type string, id, ttl string, date *time.Time, data interface{}, refresh bool) error {
+	return f.add(index, id, date, data, false)
+}
+
+func (f *fakeIndexer) UpdateWithPartialDoc(index string, _type string, id, ttl string, date *time.Time, partialDoc interface{}, upsert bool, refresh bool) error {
+	return f.add(index, id, date, partialDoc, true)
+}
+
+func (f *fakeIndexer) PendingDocuments() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.pending)
+}
+
+func (f *fakeIndexer) Flush() {
+	f.Lock()
+	defer f.Unlock()
+	f.docs = append(f.docs, f.pending...)
+	f.pending = nil
+}
+
+func (f *fakeIndexer) NumErrors() uint64 {
+	return 0
+}
+
+func (f *fakeIndexer) indexed() []indexed {
+	f.Lock()
+	defer f.Unlock()
+	return append([]indexed(nil), f.docs...)
+}
+
+// testTarget is like newEsTarget, but its stats aren't registered, so tests can make as many as they like
+func testTarget(name string, primary bool) esTarget {
+	return esTarget{name, primary, stat{val: metrics.NewCounter()}, stat{val: metrics.NewCounter()}}
+}
+
+// runTrackProto1 feeds the metric ids to a trackProto1, and returns when it has processed them all.
+// num_indexed_proto1 is then up to date, read it with .val.Count()
+func runTrackProto1(t *testing.T, indexer Indexer, targets []esTarget, ids ...string) {
+	proto1_read = make(chan string)
+	done := make(chan bool)
+	go func() {
+		trackProto1(indexer, targets)
+		done <- true
+	}()
+	for _, id := range ids {
+		proto1_read <- id
+	}
+	// it handles this once it's done with the last id
+	num_indexed_proto1.Count()
+	close(proto1_read)
+	<-done
+	proto1_read = nil
+}
+
+// runTrackProto2 feeds the metrics to a trackProto2, and returns when it has processed them all.
+// num_indexed_proto2 is then up to date, read it with .val.Count()
+func runTrackProto2(t *testing.T, indexer Indexer, targets []esTarget, ids ...string) {
+	proto2_read = make(chan trackedMetric)
+	done := make(chan bool)
+	go func() {
+		trackProto2(indexer, targets)
+		done <- true
+	}()
+	for _, id := range ids {
+		metric, _, err := parseTagBasedMetric(id)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %q", id, err)
+		}
+		proto2_read <- trackedMetric{*metric, "10.0.0.1"}
+	}
+	num_indexed_proto2.Count()
+	close(proto2_read)
+	<-done
+	proto2_read = nil
+}
+
+func TestTrackNumIndexed(t *testing.T) {
+	runTrackProto1(t, &fakeIndexer{}, []esTarget{testTarget("metrics", true)}, "foo.bar", "foo.baz", "foo.bar", "foo.bar", "foo.qux")
+	if n := num_indexed_proto1.val.Count(); n != 3 {
+		t.Errorf("expected 3 unique proto1 metrics indexed, got %d", n)
+	}
+	runTrackProto2(t, &fakeIndexer{}, []esTarget{testTarget("metrics", true)},
+		"unit=B.target_type=gauge.what=foo",
+		"unit=B.target_type=gauge.what=bar",
+		"unit=B.target_type=gauge.what=foo",
+		"unit=B.target_type=gauge.what=bar",
+	)
+	if n := num_indexed_proto2.val.Count(); n != 2 {
+		t.Errorf("expected 2 unique proto2 metrics indexed, got %d", n)
+	}
+}
+
+func TestTrackProto2Dedups(t *testing.T) {
+	indexer := &fakeIndexer{}
+	target := testTarget("metrics", true)
+	runTrackProto2(t, indexer, []esTarget{target},
+		"unit=B.target_type=gauge.what=foo",
+		"unit=B.target_type=gauge.what=bar",
+		"unit=B.target_type=gauge.what=foo",
+		"unit=B.target_type=gauge.what=foo",
+	)
+	docs := indexer.indexed()
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 documents, got %v", docs)
+	}
+	if docs[0].id != "unit=B.target_type=gauge.what=foo" || docs[1].id != "unit=B.target_type=gauge.what=bar" {
+		t.Errorf("unexpected documents %v", docs)
+	}
+	for _, d := range docs {
+		if d.index != "metrics" || d.upsert {
+			t.Errorf("%s: expected a plain index into metrics, got %v", d.id, d)
+		}
+	}
+	if n := target.ok.val.Count(); n != 2 {
+		t.Errorf("expected 2 indexed, got %d", n)
+	}
+}
+
+func TestTrackProto2SecondaryErrors(t *testing.T) {
+	indexer := &fakeIndexer{fail: map[string]bool{"metrics_new": true}}
+	primary, secondary := testTarget("metrics", true), testTarget("metrics_new", false)
+	runTrackProto2(t, indexer, []esTarget{primary, secondary},
+		"unit=B.target_type=gauge.what=foo",
+		"unit=B.target_type=gauge.what=foo",
+		"unit=B.target_type=gauge.what=bar",
+	)
+	// a failing secondary doesn't stop us, and doesn't make us index the metric again either
+	docs := indexer.indexed()
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 documents, got %v", docs)
+	}
+	for _, d := range docs {
+		if d.index != "metrics" {
+			t.Errorf("%s: indexed into %s", d.id, d.index)
+		}
+	}
+	if ok, err := primary.ok.val.Count(), primary.err.val.Count(); ok != 2 || err != 0 {
+		t.Errorf("primary: expected 2 indexed and 0 errors, got %d and %d", ok, err)
+	}
+	if ok, err := secondary.ok.val.Count(), secondary.err.val.Count(); ok != 0 || err != 2 {
+		t.Errorf("secondary: expected 0 indexed and 2 errors, got %d and %d", ok, err)
+	}
+}
+
+// an error from the primary index is fatal. that exits the process, so we check it in a copy of the test binary
+func TestTrackProto2PrimaryErrorIsFatal(t *testing.T) {
+	if os.Getenv("TEST_PRIMARY_ERROR") == "1" {
+		indexer := &fakeIndexer{fail: map[string]bool{"metrics": true}}
+		runTrackProto2(t, indexer, []esTarget{testTarget("metrics", true)}, "unit=B.target_type=gauge.what=foo")
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestTrackProto2PrimaryErrorIsFatal")
+	cmd.Env = append(os.Environ(), "TEST_PRIMARY_ERROR=1")
+	out, err := cmd.CombinedOutput()
+	if e, ok := err.(*exec.ExitError); !ok || e.Success() {
+		t.Fatalf("expected the process to exit with an error, got %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "Fatal error: index metrics is down") {
+		t.Errorf("unexpected output %s", out)
+	}
+}
+
+func TestLimitInflight(t *testing.T) {
+	var lock sync.Mutex
+	current, max := 0, 0
+	send := func(buf *bytes.Buffer) error {
+		lock.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		current--
+		lock.Unlock()
+		return nil
+	}
+	limited := limitInflight(send, make(chan bool, 3))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			limited(&bytes.Buffer{})
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if max > 3 {
+		t.Errorf("expected at most 3 sends in flight, got %d", max)
+	}
+	if max < 2 {
+		t.Errorf("expected sends to run concurrently, got at most %d in flight", max)
+	}
+	if n := es_inflight.val.Count(); n != 0 {
+		t.Errorf("expected 0 in flight when done, got %d", n)
+	}
+}
+
+func TestLimitInflightReleasesOnError(t *testing.T) {
+	sem := make(chan bool, 1)
+	limited := limitInflight(func(buf *bytes.Buffer) error { return errors.New("es is down") }, sem)
+	for i := 0; i < 3; i++ {
+		if err := limited(&bytes.Buffer{}); err == nil {
+			t.Errorf("expected the error to be passed on")
+		}
+	}
+	if len(sem) != 0 {
+		t.Errorf("semaphore was not released")
+	}
+}
+
+func TestIndexEsUpsert(t *testing.T) {
+	for _, upsert := range []bool{false, true} {
+		restore := setBool(es_upsert, upsert)
+		indexer := &fakeIndexer{}
+		date := time.Unix(1400000000, 0)
+		indexEs(indexer, []esTarget{testTarget("metrics", true), testTarget("metrics_new", false)}, "foo.bar", &date, esDoc(m20.MetricSpec{Id: "foo.bar"}), "")
+		restore()
+		docs := indexer.indexed()
+		if len(docs) != 2 {
+			t.Errorf("upsert %v: expected 2 documents, got %v", upsert, docs)
+			continue
+		}
+		for _, d := range docs {
+			if d.upsert != upsert || d.id != "foo.bar" || !d.date.Equal(date) {
+				t.Errorf("upsert %v: unexpected document %v", upsert, d)
+			}
+		}
+	}
+}
+
+// the bulk requests to a hung ES must be abandoned after elasticsearch.op_timeout, and counted as timeouts
+func TestTimeSendsTimeout(t *testing.T) {
+	hung := make(chan bool)
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte(`{"took": 1, "errors": false, "items": []}`))
+	}))
+	defer es.Close()
+	defer close(hung)
+	// what main does for elasticsearch.op_timeout
+	oldTimeout := http.DefaultClient.Timeout
+	http.DefaultClient.Timeout = 50 * time.Millisecond
+	defer func() { http.DefaultClient.Timeout = oldTimeout }()
+
+	addr := es.Listener.Addr().(*net.TCPAddr)
+	conn := elastigo.NewConn()
+	conn.Domain = addr.IP.String()
+	conn.Port = strconv.Itoa(addr.Port)
+	timer := &sampledTimer{Timer: metrics.NewTimer(), every: 1}
+	send := timeSends(conn.NewBulkIndexer(1).Send, timer)
+
+	timeouts := es_timeouts_total.val.Count()
+	pre := time.Now()
+	err := send(bytes.NewBufferString(`{"index": {"_index": "metrics", "_type": "metric", "_id": "foo"}}` + "\n{}\n"))
+	if err == nil {
+		t.Fatalf("expected the request to time out")
+	}
+	if took := time.Since(pre); took > time.Second {
+		t.Errorf("request took %s, expected it to be abandoned after 50ms", took)
+	}
+	if n := es_timeouts_total.val.Count() - timeouts; n != 1 {
+		t.Errorf("expected 1 timeout, got %d (error %q)", n, err)
+	}
+	if n := timer.Count(); n != 1 {
+		t.Errorf("expected the request to be timed, got %d", n)
+	}
+}
+
+func TestNewIndexerBulkMaxActions(t *testing.T) {
+	defer setInt(es_bulk_max_actions, 3)()
+	defer setInt(es_bulk_max_bytes, 1<<20)()
+	defer setInt(es_flush_int, 60)()
+	bulks := make(chan int, 10) // the number of actions in each bulk request
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		// every action is a line with the action, and one with the document
+		bulks <- strings.Count(string(body), "\n") / 2
+		w.Write([]byte(`{"took": 1, "errors": false, "items": []}`))
+	}))
+	defer es.Close()
+
+	addr := es.Listener.Addr().(*net.TCPAddr)
+	conn := elastigo.NewConn()
+	conn.Domain = addr.IP.String()
+	conn.Port = strconv.Itoa(addr.Port)
+	// not stopped: elastigo's Stop races with its own senders. (main never stops its indexers either)
+	indexer := newIndexer(conn, &sampledTimer{Timer: metrics.NewTimer(), every: 1}, nil)
+
+	for i := 0; i < 5; i++ {
+		err := indexer.Index("metrics", "metric", fmt.Sprintf("foo%d", i), "", nil, map[string]string{"foo": "bar"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case n := <-bulks:
+		if n != 3 {
+			t.Errorf("expected a bulk request with 3 actions, got %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected a bulk request once we had 3 documents")
+	}
+	// the other 2 wait for the flush interval
+	select {
+	case n := <-bulks:
+		t.Errorf("expected no bulk request for the remaining documents, got one with %d actions", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTrackProto2UsesClock(t *testing.T) {
+	now := time.Date(2015, 3, 17, 12, 0, 0, 0, time.UTC)
+	defer func(old func() time.Time) { clock = old }(clock)
+	clock = func() time.Time { return now }
+	indexer := &fakeIndexer{}
+	runTrackProto2(t, indexer, []esTarget{testTarget("metrics", true)}, "unit=B.target_type=gauge.what=foo")
+	now = now.Add(time.Hour)
+	runTrackProto2(t, indexer, []esTarget{testTarget("metrics", true)}, "unit=B.target_type=gauge.what=bar")
+	docs := indexer.indexed()
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 documents, got %v", docs)
+	}
+	if !docs[0].date.Equal(time.Date(2015, 3, 17, 12, 0, 0, 0, time.UTC)) || !docs[1].date.Equal(time.Date(2015, 3, 17, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the documents to be dated by the clock, got %s and %s", docs[0].date, docs[1].date)
+	}
+}
+
+func TestEsRoute(t *testing.T) {
+	cases := []struct {
+		tags  map[string]string
+		route string
+	}{
+		{map[string]string{"unit": "B", "tenant": "acme"}, "acme"},
+		{map[string]string{"unit": "B"}, ""}, // no tenant: the default index
+		{map[string]string{"unit": "B", "tenant": "Acme Corp/EU_1"}, "acmecorpeu_1"},
+		{map[string]string{"unit": "B", "tenant": "../*"}, ""}, // nothing safe left
+	}
+	for _, c := range cases {
+		if route := esRoute(c.tags); route != "" {
+			t.Errorf("%v: expected no route without elasticsearch.route_by_tag, got %s", c.tags, route)
+		}
+		restore := setString(es_route_by_tag, "tenant")
+		route := esRoute(c.tags)
+		restore()
+		if route != c.route {
+			t.Errorf("%v: expected route '%s', got '%s'", c.tags, c.route, route)
+		}
+	}
+}
+
+func TestTrackProto2RoutesByTag(t *testing.T) {
+	defer setString(es_route_by_tag, "tenant")()
+	indexer := &fakeIndexer{}
+	runTrackProto2(t, indexer, []esTarget{testTarget("metrics", true), testTarget("metrics_new", false)},
+		"unit=B.target_type=gauge.tenant=acme.what=foo",
+		"unit=B.target_type=gauge.what=foo",
+	)
+	var got []string
+	for _, d := range indexer.indexed() {
+		got = append(got, d.index+" "+d.id)
+	}
+	expected := []string{
+		"metrics_acme unit=B.target_type=gauge.tenant=acme.what=foo",
+		"metrics_new_acme unit=B.target_type=gauge.tenant=acme.what=foo",
+		"metrics unit=B.target_type=gauge.what=foo",
+		"metrics_new unit=B.target_type=gauge.what=foo",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestTrackProto2SkipsOversizedDocs(t *testing.T) {
+	defer setInt(es_max_doc_bytes, 1000)()
+	nodes := []string{"unit=B", "target_type=gauge"}
+	for i := 0; i < 100; i++ {
+		nodes = append(nodes, fmt.Sprintf("tag%c%c=value%d", 'a'+i/26, 'a'+i%26, i))
+	}
+	big := strings.Join(nodes, ".")
+	small := "unit=B.target_type=gauge.what=foo"
+	if _, fits := docFits(esDoc(m20.MetricSpec{Id: small, Tags: map[string]string{"unit": "B", "target_type": "gauge", "what": "foo"}})); !fits {
+		t.Fatalf("expected the document of %s to fit", small)
+	}
+	tooBig := es_docs_too_big_total.val.Count()
+	indexer := &fakeIndexer{}
+	runTrackProto2(t, indexer, []esTarget{testTarget("metrics", true)}, big, small, big)
+	docs := indexer.indexed()
+	if len(docs) != 1 || docs[0].id != small {
+		t.Errorf("expected only %s to be indexed, got %v", small, docs)
+	}
+	if n := num_indexed_proto2.val.Count(); n != 1 {
+		t.Errorf("expected the metrics that are too big not to count as indexed, got %d", n)
+	}
+	// we remember it's too big, so we don't serialize it again
+	if n := es_docs_too_big_total.val.Count() - tooBig; n != 1 {
+		t.Errorf("expected 1 document too big, got %d", n)
+	}
+}
+
+func TestValueSemantics(t *testing.T) {
+	cases := []struct {
+		id        string
+		semantics string
+	}{
+		{"unit=Err/s.target_type=rate.what=errors", "rate"},
+		{"unit=Err.target_type=count.what=errors", "count"},
+		{"unit=Err.target_type=counter.what=errors", "counter"},
+		{"unit=B.target_type=gauge.what=foo", "gauge"},
+		{"unit=s.target_type=timestamp.what=last_run", "timestamp"},
+		// without a target_type we know of, a rate unit still tells us
+		{"unit=Errps.target_type=foo.what=errors", "rate"}, // rewritten to Err/s
+		{"unit=Err/s.target_type=foo.what=errors", "rate"},
+		{"unit=Err.target_type=foo.what=errors", ""},
+		// the target_type wins
+		{"unit=B/s.target_type=gauge.what=foo", "gauge"},
+	}
+	for _, c := range cases {
+		spec, _, err := parseTagBasedMetric(c.id)
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.id, err)
+			continue
+		}
+		if semantics := valueSemantics(spec.Tags); semantics != c.semantics {
+			t.Errorf("%s: expected value semantics %q, got %q", c.id, c.semantics, semantics)
+		}
+	}
+}
+
+func TestEsDocLayouts(t *testing.T) {
+	spec := m20.MetricSpec{Id: "unit=B.target_type=gauge.what=foo", Tags: map[string]string{"unit": "B", "target_type": "gauge", "what": "foo"}}
+	cases := []struct {
+		layout    string
+		semantics bool
+		json      string
+	}{
+		{"kv_list", false, `{"tags":["target_type=gauge","unit=B","what=foo"]}`},
+		{"kv_list", true, `{"tags":["target_type=gauge","unit=B","what=foo"],"value_semantics":"gauge"}`},
+		{"nested", false, `{"tags":{"target_type":"gauge","unit":"B","what":"foo"}}`},
+		{"nested", true, `{"tags":{"target_type":"gauge","unit":"B","what":"foo"},"value_semantics":"gauge"}`},
+		{"flat", false, `{"tag_target_type":"gauge","tag_unit":"B","tag_what":"foo"}`},
+		{"flat", true, `{"tag_target_type":"gauge","tag_unit":"B","tag_what":"foo","value_semantics":"gauge"}`},
+	}
+	for _, c := range cases {
+		restoreLayout := setString(es_tag_layout, c.layout)
+		restoreSemantics := setBool(es_derive_semantics, c.semantics)
+		doc := esDoc(spec)
+		restoreSemantics()
+		restoreLayout()
+		// the order of the kv_list tags is up to m20
+		if kv, ok := doc.(kvListDoc); ok {
+			sort.Strings(kv.Tags)
+			doc = kv
+		}
+		buf, err := json.Marshal(doc)
+		if err != nil {
+			t.Errorf("%s: %s", c.layout, err)
+			continue
+		}
+		if string(buf) != c.json {
+			t.Errorf("%s (semantics %v): expected %s, got %s", c.layout, c.semantics, c.json, buf)
+		}
+	}
+}
+
+func TestEsDocLegacy(t *testing.T) {
+	expected := map[string]string{"kv_list": `{"tags":[]}`, "nested": `{"tags":{}}`, "flat": `{}`}
+	for layout, js := range expected {
+		restore := setString(es_tag_layout, layout)
+		buf, err := json.Marshal(esDoc(m20.MetricSpec{Id: "servers.web1.cpu"}))
+		restore()
+		if err != nil || string(buf) != js {
+			t.Errorf("%s: expected %s, got %s (%v)", layout, js, buf, err)
+		}
+	}
+}
+
+func TestShedRate(t *testing.T) {
+	defer setInt(es_shed_high_water, 100)()
+	defer setInt(es_shed_sample, 10)()
+	cases := []struct {
+		current, queued, rate int
+	}{
+		{1, 0, 1},
+		{1, 99, 1},
+		{1, 100, 10}, // at the high-water mark, we start sampling
+		{1, 1000, 10},
+		{10, 99, 10}, // until we're down to half of it
+		{10, 51, 10},
+		{10, 50, 1},
+		{10, 0, 1},
+	}
+	for _, c := range cases {
+		if rate := shedRate(c.current, c.queued); rate != c.rate {
+			t.Errorf("rate %d, %d queued: expected rate %d, got %d", c.current, c.queued, c.rate, rate)
+		}
+	}
+}
+
+func TestTrackProto2Sheds(t *testing.T) {
+	defer setInt(es_shed_high_water, 10)()
+	defer setInt(es_shed_sample, 5)()
+	// all queued up front, so trackProto2 sees the queue go from 19 down to 0
+	proto2_read = make(chan trackedMetric, 20)
+	for i := 1; i <= 20; i++ {
+		metric, _, err := parseTagBasedMetric(fmt.Sprintf("unit=B.target_type=gauge.what=foo%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		proto2_read <- trackedMetric{*metric, "10.0.0.1"}
+	}
+	shed := es_shed_total.val.Count()
+	indexer := &fakeIndexer{}
+	done := make(chan bool)
+	go func() {
+		trackProto2(indexer, []esTarget{testTarget("metrics", true)})
+		done <- true
+	}()
+	for len(proto2_read) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// it handles this once it's done with the last metric
+	indexedUnique := num_indexed_proto2.Count()
+	close(proto2_read)
+	<-done
+	proto2_read = nil
+
+	// 1 in 5 while the queue is at 10 or more, and until it's down to 5. then all of them
+	var got []string
+	for _, d := range indexer.indexed() {
+		got = append(got, strings.TrimPrefix(d.id, "unit=B.target_type=gauge.what=foo"))
+	}
+	if strings.Join(got, ",") != "5,10,15,16,17,18,19,20" {
+		t.Errorf("unexpected metrics indexed: %v", got)
+	}
+	if n := es_shed_total.val.Count() - shed; n != 12 {
+		t.Errorf("expected 12 shed, got %d", n)
+	}
+	if indexedUnique != 8 {
+		t.Errorf("expected only the 8 metrics that weren't shed to count as indexed, got %d", indexedUnique)
+	}
+	if rate := es_sample_every.val.Count(); rate != 1 {
+		t.Errorf("expected to be back at indexing all new metrics, got 1 in %d", rate)
+	}
+}
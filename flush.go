@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// POST /flush on the stats http address sends the documents pending in the ES indexers right away,
+// rather than at the next elasticsearch.flush_interval, so that new metrics show up in ES immediately.
+// we allow one flush per second, so it can't be used to hammer ES.
+
+type flusher interface {
+	Flush()
+	PendingDocuments() int
+}
+
+func flushHandler(indexers ...flusher) http.HandlerFunc {
+	var lock sync.Mutex
+	var last time.Time
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(last) < time.Second {
+			http.Error(w, "flushed less than a second ago, try again later", http.StatusTooManyRequests)
+			return
+		}
+		last = time.Now()
+		n := 0
+		for _, indexer := range indexers {
+			n += indexer.PendingDocuments()
+			indexer.Flush()
+		}
+		fmt.Fprintf(w, "flushed %d documents\n", n)
+	}
+}
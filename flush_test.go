@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFlushHandler(t *testing.T) {
+	indexer1, indexer2 := &fakeIndexer{buffer: true}, &fakeIndexer{buffer: true}
+	runTrackProto2(t, indexer2, []esTarget{testTarget("metrics", true)}, "unit=B.target_type=gauge.what=foo", "unit=B.target_type=gauge.what=bar")
+	if docs := indexer2.indexed(); len(docs) != 0 {
+		t.Fatalf("expected the documents to be pending, got %v", docs)
+	}
+	handler := flushHandler(indexer1, indexer2)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/flush", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/flush", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "flushed 2 documents\n" {
+		t.Errorf("expected 2 documents flushed, got %d: %s", w.Code, w.Body.String())
+	}
+	if docs := indexer2.indexed(); len(docs) != 2 {
+		t.Errorf("expected the documents to be indexed, got %v", docs)
+	}
+
+	// right after, we refuse
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/flush", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d flushing again right away, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
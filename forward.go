@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// forwarding of valid lines, unaltered, to carbon daemons like carbon-cache or carbon-relay.
+// every destination has its own connection and queue; if a destination is down or too slow, we queue up until
+// its backlog is full and then drop, so that the tagging, the indexing and the other destinations keep going.
+
+type destination struct {
+	addr  string
+	lines chan []byte
+
+	conns_current       stat
+	conns_broken_total  stat
+	lines_total         stat
+	lines_dropped_total stat
+	pending_backlog     stat
+}
+
+func newDestination(addr string) *destination {
+	// the address goes into the stat names, which can't have dots
+	tag := "dest_is_" + strings.NewReplacer(".", "_", ":", "_").Replace(addr)
+	return &destination{
+		addr:                addr,
+		lines:               make(chan []byte, *out_max_backlog),
+		conns_current:       NewGauge("unit_is_Conn.direction_is_out.type_is_open."+tag, false),
+		conns_broken_total:  NewCounter("unit_is_Conn.direction_is_out.type_is_broken."+tag, false),
+		lines_total:         NewCounter("unit_is_Msg.direction_is_out.type_is_forwarded."+tag, false),
+		lines_dropped_total: NewCounter("unit_is_Err.orig_unit_is_Msg.direction_is_out.type_is_dropped."+tag, false),
+		pending_backlog:     NewCounter("unit_is_Msg.direction_is_out.type_is_pending_in_backlog."+tag, true),
+	}
+}
+
+// outDestinations returns the addresses to forward to: out.destinations if set, otherwise out.host and out.port
+func outDestinations() []string {
+	if *out_destinations == "" {
+		if *out_host == "" {
+			return nil
+		}
+		return []string{net.JoinHostPort(*out_host, strconv.Itoa(*out_port))}
+	}
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range strings.Split(*out_destinations, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" && !seen[addr] {
+			addrs = append(addrs, addr)
+			seen[addr] = true
+		}
+	}
+	return addrs
+}
+
+// forward queues a line for all out destinations, or with consistent hashing, for the one the metric id maps to
+func forward(id string, buf []byte) {
+	if out_ring != nil {
+		out_ring.get(id).queue(buf)
+		return
+	}
+	for _, dest := range destinations {
+		dest.queue(buf)
+	}
+}
+
+// rawId returns the metric id of a line we haven't processed, for routing with out.tee_raw
+func rawId(buf []byte) string {
+	buf = bytes.TrimLeft(buf, " ")
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(bytes.TrimSpace(buf))
+}
+
+func (dest *destination) queue(buf []byte) {
+	select {
+	case dest.lines <- buf:
+	default:
+		dest.lines_dropped_total.Inc(1)
+	}
+}
+
+func (dest *destination) forwardLines() {
+	// we're not always in a position to respond promptly, but the length of a channel can be read from anywhere
+	go func() {
+		for _ = range dest.pending_backlog.valueReq {
+			dest.pending_backlog.valueResp <- int64(len(dest.lines))
+		}
+	}()
+	backoff := time.Second
+	for {
+		conn, err := net.Dial("tcp", dest.addr)
+		if err != nil {
+			fmt.Printf("WARN could not connect to %s: %s. retrying in %s\n", dest.addr, err.Error(), backoff)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		dest.conns_current.Update(1)
+		err = dest.writeLines(conn)
+		dest.conns_current.Update(0)
+		fmt.Printf("WARN connection to %s broken: %s. reconnecting\n", dest.addr, err.Error())
+		dest.conns_broken_total.Inc(1)
+		conn.Close()
+	}
+}
+
+// writeLines writes lines to the connection until a write fails.
+// we flush whenever we don't have more lines queued up, so we don't hold on to data.
+// with out.gzip, every connection is a fresh gzip stream. flushing the compressor often hurts the
+// compression, so then we only flush every out.gzip_flush_interval.
+func (dest *destination) writeLines(conn net.Conn) error {
+	var out io.Writer = conn
+	var gz *gzip.Writer
+	var tick <-chan time.Time
+	if *out_gzip {
+		gz = gzip.NewWriter(conn)
+		out = gz
+		ticker := time.NewTicker(time.Duration(*out_gzip_flush_int) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	w := bufio.NewWriter(out)
+	flush := func() error {
+		err := w.Flush()
+		if err == nil && gz != nil {
+			err = gz.Flush()
+		}
+		return err
+	}
+	for {
+		select {
+		case buf := <-dest.lines:
+			_, err := w.Write(buf)
+			if err != nil {
+				dest.lines_dropped_total.Inc(1)
+				return err
+			}
+			dest.lines_total.Inc(1)
+			if gz == nil && len(dest.lines) == 0 {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+		case <-tick:
+			err := flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
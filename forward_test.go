@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDestination is like newDestination, but its stats aren't registered, so tests can make as many as they like
+func testDestination(addr string) *destination {
+	return &destination{
+		addr:                addr,
+		lines:               make(chan []byte, 100),
+		conns_current:       stat{val: metrics.NewCounter()},
+		conns_broken_total:  stat{val: metrics.NewCounter()},
+		lines_total:         stat{val: metrics.NewCounter()},
+		lines_dropped_total: stat{val: metrics.NewCounter()},
+		pending_backlog:     stat{val: metrics.NewCounter()},
+	}
+}
+
+// readGzipLines decompresses n lines from the connection
+func readGzipLines(t *testing.T, conn net.Conn, n int) []string {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	gz, err := gzip.NewReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(gz)
+	var lines []string
+	for len(lines) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %d lines: %s", len(lines), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestWriteLinesGzip(t *testing.T) {
+	defer setBool(out_gzip, true)()
+	defer setInt(out_gzip_flush_int, 10)()
+	dest := testDestination("test")
+	sent := []string{"foo.bar 1 1400000000\n", "unit=B.target_type=gauge.what=foo 2 1400000000\n"}
+
+	// every connection, e.g. after a reconnect, is a gzip stream of its own
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		done := make(chan error)
+		go func() {
+			done <- dest.writeLines(client)
+		}()
+		for _, line := range sent {
+			dest.queue([]byte(line))
+		}
+		// without more lines coming, we get them after the flush interval
+		got := readGzipLines(t, server, len(sent))
+		for j := range sent {
+			if got[j] != sent[j] {
+				t.Errorf("connection %d: expected line %q, got %q", i, sent[j], got[j])
+			}
+		}
+		server.Close()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("connection %d: expected an error from the broken connection", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connection %d: writeLines did not notice the broken connection", i)
+		}
+		client.Close()
+	}
+	if n := dest.lines_total.val.Count(); n != 4 {
+		t.Errorf("expected 4 lines forwarded, got %d", n)
+	}
+}
+
+// fakeDownstream is a carbon daemon that sends every line it receives on lines
+type fakeDownstream struct {
+	l     net.Listener
+	lines chan string
+
+	sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeDownstream(t *testing.T) *fakeDownstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDownstream{l: l, lines: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			d.Lock()
+			d.conns = append(d.conns, conn)
+			d.Unlock()
+			go func() {
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					d.lines <- line
+				}
+			}()
+		}
+	}()
+	return d
+}
+
+// kill takes the downstream down, connections and all
+func (d *fakeDownstream) kill() {
+	d.l.Close()
+	d.Lock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.Unlock()
+}
+
+func (d *fakeDownstream) receive(t *testing.T, expected string) {
+	select {
+	case line := <-d.lines:
+		if line != expected {
+			t.Errorf("%s: expected %q, got %q", d.l.Addr(), expected, line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s: didn't receive %q", d.l.Addr(), expected)
+	}
+}
+
+func TestForwardDeadDestination(t *testing.T) {
+	healthy, dying := newFakeDownstream(t), newFakeDownstream(t)
+	defer healthy.kill()
+	defer dying.kill()
+	d1, d2 := testDestination(healthy.l.Addr().String()), testDestination(dying.l.Addr().String())
+	defer func(old []*destination) { destinations = old }(destinations)
+	destinations = []*destination{d1, d2}
+	go d1.forwardLines()
+	go d2.forwardLines()
+
+	forward("foo.bar", []byte("foo.bar 1 1400000000\n"))
+	healthy.receive(t, "foo.bar 1 1400000000\n")
+	dying.receive(t, "foo.bar 1 1400000000\n")
+
+	dying.kill()
+	for i := 2; i < 200; i++ {
+		line := fmt.Sprintf("foo.bar %d 1400000000\n", i)
+		forward("foo.bar", []byte(line))
+		healthy.receive(t, line)
+	}
+	if n := d1.lines_dropped_total.val.Count(); n != 0 {
+		t.Errorf("expected nothing dropped for the healthy destination, got %d", n)
+	}
+	// its queue is full by now, or it noticed the broken connection, and is trying to reconnect
+	if d2.lines_dropped_total.val.Count() == 0 && d2.conns_broken_total.val.Count() == 0 {
+		t.Errorf("expected the dead destination to drop lines, or to have noticed the broken connection")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// with in.framing = "length_prefixed", connections don't send plain lines, but frames:
+// a 4 byte big-endian length, followed by that many bytes of (newline separated) lines.
+// a frame that claims to be longer than in.max_frame_len is a framing error: we don't want to allocate
+// whatever a sender tells us to. after a framing error we can't find the next frame, so we drop the connection.
+
+type framingError struct {
+	msg string
+}
+
+func (e framingError) Error() string {
+	return e.msg
+}
+
+// readFrames reads frames until the connection ends, and returns the error that ended it
+func readFrames(reader *bufio.Reader, proto int, source, sender string) error {
+	var header [4]byte
+	for {
+		ingest.wait()
+		_, err := io.ReadFull(reader, header[:])
+		if err == io.ErrUnexpectedEOF {
+			return framingError{"connection closed in the middle of a frame header"}
+		}
+		if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n > uint32(*in_max_frame_len) {
+			return framingError{fmt.Sprintf("frame of %d bytes exceeds in.max_frame_len", n)}
+		}
+		payload := make([]byte, n)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return framingError{fmt.Sprintf("connection closed in the middle of a frame of %d bytes", n)}
+		}
+		if err != nil {
+			return err
+		}
+		for _, buf := range bytes.SplitAfter(payload, []byte("\n")) {
+			if len(bytes.TrimSpace(buf)) == 0 {
+				continue
+			}
+			if buf[len(buf)-1] != '\n' {
+				buf = append(buf, '\n')
+			}
+			received(inLine{buf, proto, source, sender})
+		}
+	}
+}
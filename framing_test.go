@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// frame returns payload as a length prefixed frame
+func frame(payload string) string {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	return string(header[:]) + payload
+}
+
+// readLines runs a connection that sends data through handleClient, and returns the lines it read
+func readLines(data string) []string {
+	lines_read = make(chan inLine, 100)
+	handleClient(newMockConn(data, io.EOF), protoAuto)
+	close(lines_read)
+	var lines []string
+	for l := range lines_read {
+		lines = append(lines, string(l.buf))
+	}
+	lines_read = nil
+	return lines
+}
+
+func TestFraming(t *testing.T) {
+	defer setInt(in_max_frame_len, 100)()
+	cases := []struct {
+		framing string
+		data    string
+		lines   []string
+		bad     int64 // framing errors
+	}{
+		{"newline", "foo.bar 1 1400000000\nfoo.baz 2 1400000000\n", []string{"foo.bar 1 1400000000\n", "foo.baz 2 1400000000\n"}, 0},
+		{"length_prefixed", frame("foo.bar 1 1400000000\n") + frame("foo.baz 2 1400000000"), []string{"foo.bar 1 1400000000\n", "foo.baz 2 1400000000\n"}, 0},
+		// a frame can have several lines
+		{"length_prefixed", frame("foo.bar 1 1400000000\nfoo.baz 2 1400000000\n\n"), []string{"foo.bar 1 1400000000\n", "foo.baz 2 1400000000\n"}, 0},
+		{"length_prefixed", frame(""), nil, 0},
+		// truncated frames
+		{"length_prefixed", frame("foo.bar 1 1400000000\n") + frame("foo.baz 2 1400000000\n")[:10], []string{"foo.bar 1 1400000000\n"}, 1},
+		{"length_prefixed", frame("foo.bar 1 1400000000\n")[:2], nil, 1},
+		// an absurd length
+		{"length_prefixed", "\xff\xff\xff\xff" + "foo.bar 1 1400000000\n", nil, 1},
+		{"length_prefixed", frame(strings.Repeat("x", 101)), nil, 1},
+		{"length_prefixed", frame(strings.Repeat("x", 100)), []string{strings.Repeat("x", 100) + "\n"}, 0},
+	}
+	for _, c := range cases {
+		restore := setString(in_framing, c.framing)
+		bad := in_frames_bad_total.val.Count()
+		lines := readLines(c.data)
+		restore()
+		if strings.Join(lines, "") != strings.Join(c.lines, "") {
+			t.Errorf("%s %q: expected lines %q, got %q", c.framing, c.data, c.lines, lines)
+		}
+		if n := in_frames_bad_total.val.Count() - bad; n != c.bad {
+			t.Errorf("%s %q: expected %d framing errors, got %d", c.framing, c.data, c.bad, n)
+		}
+	}
+}
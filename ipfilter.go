@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ipFilter decides which remote addresses may connect, based on in.ip_blocklist and in.ip_allowlist.
+// both are comma separated lists of IPs and/or CIDRs. blocked addresses are always refused.
+// if there's an allowlist, only addresses in it are accepted.
+type ipFilter struct {
+	block []*net.IPNet
+	allow []*net.IPNet
+}
+
+func newIpFilter(blocklist, allowlist string) (*ipFilter, error) {
+	block, err := parseNets(blocklist)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parseNets(allowlist)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilter{block, allow}, nil
+}
+
+func parseNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR '%s'", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (f *ipFilter) allowed(ip net.IP) bool {
+	for _, n := range f.block {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the current filter. it gets replaced on reload
+var (
+	ip_filter     *ipFilter
+	ip_filterLock sync.RWMutex
+)
+
+func setIpFilter(f *ipFilter) {
+	ip_filterLock.Lock()
+	ip_filter = f
+	ip_filterLock.Unlock()
+}
+
+// connAllowed returns whether the connection may proceed, based on its remote address
+func connAllowed(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip_filterLock.RLock()
+	f := ip_filter
+	ip_filterLock.RUnlock()
+	return f == nil || f.allowed(addr.IP)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestIpFilterAllowed(t *testing.T) {
+	cases := []struct {
+		block, allow string
+		ip           string
+		allowed      bool
+	}{
+		{"", "", "10.0.0.1", true},
+		{"10.0.0.1", "", "10.0.0.1", false},
+		{"10.0.0.1", "", "10.0.0.2", true},
+		{"10.0.0.0/24", "", "10.0.0.255", false},
+		{"10.0.0.0/24", "", "10.0.1.0", true},
+		{"", "192.168.0.0/16, 10.0.0.1", "192.168.3.4", true},
+		{"", "192.168.0.0/16, 10.0.0.1", "10.0.0.1", true},
+		{"", "192.168.0.0/16, 10.0.0.1", "10.0.0.2", false},
+		{"192.168.1.0/24", "192.168.0.0/16", "192.168.1.1", false}, // the blocklist wins
+		{"192.168.1.0/24", "192.168.0.0/16", "192.168.2.1", true},
+		{"2001:db8::/32", "", "2001:db8::1", false},
+		{"2001:db8::1", "", "2001:db8::2", true},
+		{"10.0.0.0/8", "", "2001:db8::1", true},
+	}
+	for _, c := range cases {
+		f, err := newIpFilter(c.block, c.allow)
+		if err != nil {
+			t.Errorf("block %s, allow %s: unexpected error %q", c.block, c.allow, err)
+			continue
+		}
+		if allowed := f.allowed(net.ParseIP(c.ip)); allowed != c.allowed {
+			t.Errorf("block %s, allow %s: expected %s to be allowed: %v, got %v", c.block, c.allow, c.ip, c.allowed, allowed)
+		}
+	}
+}
+
+func TestNewIpFilterInvalid(t *testing.T) {
+	for _, list := range []string{"10.0.0", "10.0.0.0/33", "web1", "10.0.0.1,,foo"} {
+		if _, err := newIpFilter(list, ""); err == nil {
+			t.Errorf("blocklist %s: expected an error", list)
+		}
+		if _, err := newIpFilter("", list); err == nil {
+			t.Errorf("allowlist %s: expected an error", list)
+		}
+	}
+}
+
+func TestServeFiltersIps(t *testing.T) {
+	defer setIpFilter(nil)
+	l := testListener(t)
+	go l.serve()
+	defer l.shutdown()
+
+	blocked, err := newIpFilter("127.0.0.0/8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setIpFilter(blocked)
+	refused := in_conns_refused_total.val.Count()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", l.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn)
+	conn.Close()
+	if n := in_conns_refused_total.val.Count() - refused; n != 1 {
+		t.Errorf("expected 1 refused connection, got %d", n)
+	}
+
+	allowed, err := newIpFilter("10.0.0.0/8", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setIpFilter(allowed)
+	accepted := in_conns_accepted_total.val.Count()
+	conn = dialTest(t, l, 1) // it's being handled
+	defer conn.Close()
+	if n := in_conns_accepted_total.val.Count() - accepted; n != 1 {
+		t.Errorf("expected 1 accepted connection, got %d", n)
+	}
+}
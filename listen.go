@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// listener accepts connections for incoming metrics on a port, and keeps track of them,
+// so that when we move to a different port, we can drain the connections of the old one.
+type listener struct {
+	port  int
+	proto int
+	l     net.Listener
+
+	sync.Mutex
+	closed bool
+	conns  map[net.Conn]bool
+}
+
+func newListener(port, proto int) (*listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{
+		port:  port,
+		proto: proto,
+		l:     l,
+		conns: make(map[net.Conn]bool),
+	}, nil
+}
+
+// serve accepts connections until the listener is closed.
+// if accepting fails (e.g. we ran out of file descriptors) we back off, rather than spinning on the error.
+func (l *listener) serve() {
+	fmt.Printf("carbon-tagger %s listening on %d\n", *stats_id, l.port)
+	var backoff time.Duration
+	for {
+		// would be nice to have a metric showing highest amount of connections seen per interval
+		conn_in, err := l.l.Accept()
+		if err != nil {
+			l.Lock()
+			closed := l.closed
+			l.Unlock()
+			if closed {
+				return
+			}
+			in_conns_accept_errors_total.Inc(1)
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			fmt.Fprintf(os.Stderr, "accept error: %s. retrying in %s\n", err.Error(), backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if !connAllowed(conn_in) {
+			in_conns_refused_total.Inc(1)
+			conn_in.Close()
+			continue
+		}
+		in_conns_accepted_total.Inc(1)
+		conn_in = wrapTLS(conn_in)
+		l.Lock()
+		// we may have been drained or shut down since the Accept, and then they don't know about this connection
+		if l.closed {
+			l.Unlock()
+			conn_in.Close()
+			return
+		}
+		l.conns[conn_in] = true
+		l.Unlock()
+		go func() {
+			handleClient(conn_in, l.proto)
+			l.Lock()
+			delete(l.conns, conn_in)
+			l.Unlock()
+		}()
+	}
+}
+
+// drain stops accepting new connections. existing connections can keep sending
+// for the grace period, after which the ones still open are closed.
+func (l *listener) drain(grace time.Duration) {
+	l.Lock()
+	l.closed = true
+	l.Unlock()
+	l.l.Close()
+	time.AfterFunc(grace, func() {
+		l.Lock()
+		defer l.Unlock()
+		if len(l.conns) > 0 {
+			fmt.Printf("closing %d remaining connections on old port %d\n", len(l.conns), l.port)
+		}
+		for conn := range l.conns {
+			conn.Close()
+		}
+	})
+}
+
+// shutdown stops accepting new connections, closes the open ones, and returns once they're all done
+func (l *listener) shutdown() {
+	l.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.Unlock()
+	l.l.Close()
+	for l.numConns() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// numConns returns how many connections are still open
+func (l *listener) numConns() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.conns)
+}
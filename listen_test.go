@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testListener listens on a free port
+func testListener(t *testing.T) *listener {
+	l, err := newListener(0, protoAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.port = l.l.Addr().(*net.TCPAddr).Port
+	return l
+}
+
+// dialTest connects to the listener, and waits until it has taken the connection
+func dialTest(t *testing.T, l *listener, conns int) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", l.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; l.numConns() < conns; i++ {
+		if i == 100 {
+			t.Fatalf("listener has %d connections, expected %d", l.numConns(), conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return conn
+}
+
+// expectClosed checks that we closed the connection on our side
+func expectClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("expected the connection to be closed")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Errorf("connection is still open")
+	}
+}
+
+// a connection accepted just as we stop accepting must not be left open: drain and shutdown don't know about it
+func TestServeClosesConnAcceptedAfterClose(t *testing.T) {
+	l := testListener(t)
+	defer l.l.Close()
+	// what drain and shutdown do, but without closing the socket yet, as if they ran between the Accept and serve's check
+	l.closed = true
+	done := make(chan bool)
+	go func() {
+		l.serve()
+		done <- true
+	}()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", l.port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectClosed(t, conn)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("serve did not return")
+	}
+	if n := l.numConns(); n != 0 {
+		t.Errorf("expected no connections to be tracked, got %d", n)
+	}
+}
+
+func TestShutdownDrainingListener(t *testing.T) {
+	l := testListener(t)
+	go l.serve()
+	conn := dialTest(t, l, 1)
+	defer conn.Close()
+	l.drain(time.Hour)
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", l.port)); err == nil {
+		t.Errorf("a draining listener should not accept new connections")
+	}
+	if stillOpen([]*listener{l}) == nil {
+		t.Errorf("expected the listener to still have its connection")
+	}
+	done := make(chan bool)
+	go func() {
+		l.shutdown()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("shutdown did not return")
+	}
+	expectClosed(t, conn)
+	if stillOpen([]*listener{l}) != nil {
+		t.Errorf("expected the listener to have no connections left")
+	}
+}
+
+func TestReloadPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-tagger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setString(configFile, filepath.Join(dir, "carbon-tagger.conf"))()
+	defer setString(configDir, "")()
+	defer setIpFilter(nil)
+	current := testListener(t)
+	defer current.l.Close()
+	write := func(port int) {
+		err := ioutil.WriteFile(*configFile, []byte(fmt.Sprintf("[in]\nport = %d\n", port)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(current.port)
+	next, err := reload(current)
+	if err != nil || next != current {
+		t.Errorf("same port: expected the current listener, got %v, %v", next, err)
+	}
+
+	free := testListener(t)
+	port := free.port
+	free.l.Close()
+	write(port)
+	next, err = reload(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.l.Close()
+	if next == current || next.port != port || next.proto != current.proto {
+		t.Errorf("expected a listener on port %d, got %v", port, next)
+	}
+
+	// the port is taken now
+	next2, err := reload(current)
+	if err == nil {
+		next2.l.Close()
+		t.Errorf("expected an error listening on a port in use")
+	}
+}
+
+// failingListener fails to accept, like a listener that ran out of file descriptors.
+// after failures errors, it acts as if the listener was closed.
+type failingListener struct {
+	l        *listener
+	failures int
+	accepts  []time.Time
+}
+
+func (f *failingListener) Accept() (net.Conn, error) {
+	f.accepts = append(f.accepts, time.Now())
+	if len(f.accepts) > f.failures {
+		f.l.Lock()
+		f.l.closed = true
+		f.l.Unlock()
+	}
+	return nil, errors.New("too many open files")
+}
+
+func (f *failingListener) Close() error   { return nil }
+func (f *failingListener) Addr() net.Addr { return &net.TCPAddr{Port: 2003} }
+
+func TestServeBacksOffOnAcceptErrors(t *testing.T) {
+	l := &listener{port: 2003, conns: make(map[net.Conn]bool)}
+	f := &failingListener{l: l, failures: 5}
+	l.l = f
+	errs := in_conns_accept_errors_total.val.Count()
+	l.serve()
+	if n := in_conns_accept_errors_total.val.Count() - errs; n != 5 {
+		t.Errorf("expected 5 accept errors, got %d", n)
+	}
+	// we wait 5ms after the first error, and twice as long after every next one
+	for i := 1; i < len(f.accepts); i++ {
+		wait := f.accepts[i].Sub(f.accepts[i-1])
+		if min := time.Duration(5<<uint(i-1)) * time.Millisecond; wait < min {
+			t.Errorf("accept %d: expected to wait at least %s, waited %s", i, min, wait)
+		}
+	}
+}
+
+// every connection has a goroutine in handleClient, which must be gone once the connection is
+func TestConnectionsDontLeakGoroutines(t *testing.T) {
+	lines_read = make(chan inLine, 1000)
+	defer func() { lines_read = nil }()
+	baseline := runtime.NumGoroutine()
+	l := testListener(t)
+	go l.serve()
+
+	var conns []net.Conn
+	for i := 0; i < 50; i++ {
+		conn := dialTest(t, l, i+1)
+		fmt.Fprintf(conn, "foo.bar %d 1400000000\n", i)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for i := 0; l.numConns() > 0; i++ {
+		if i == 200 {
+			t.Fatalf("%d connections still open after the clients closed them", l.numConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(lines_read); n != 50 {
+		t.Errorf("expected 50 lines read, got %d", n)
+	}
+	l.shutdown()
+
+	// the goroutines may take a moment to actually exit. a few unrelated ones (e.g. of the runtime) may come and go
+	var n int
+	for i := 0; i < 100; i++ {
+		if n = runtime.NumGoroutine(); n <= baseline+2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected about %d goroutines after the connections closed, got %d", baseline, n)
+}
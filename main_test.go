@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+// the stats and the parser settings are globals that main sets up, so we do the same here, once for all tests.
+// tests that change a setting restore it when they're done, see setBool and co.
+func TestMain(m *testing.M) {
+	initStats()
+	err := initUnitRewrites(*parse_unit_rewrites, *parse_unit_exceptions)
+	if err != nil {
+		panic(err)
+	}
+	tag_key_pattern = regexp.MustCompile(*parse_tag_key_pattern)
+	os.Exit(m.Run())
+}
+
+// setBool, setInt and setString change a config setting, and return a func that restores it, to defer
+func setBool(setting *bool, v bool) func() {
+	old := *setting
+	*setting = v
+	return func() { *setting = old }
+}
+
+func setInt(setting *int, v int) func() {
+	old := *setting
+	*setting = v
+	return func() { *setting = old }
+}
+
+func setString(setting *string, v string) func() {
+	old := *setting
+	*setting = v
+	return func() { *setting = old }
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rejection is returned for metrics we refuse for a specific reason,
+// so the caller can account for it in the stat dedicated to that reason
+type rejection struct {
+	reason *stat
+	msg    string
+}
+
+func (r rejection) Error() string {
+	return r.msg
+}
+
+// splitLine splits a line into its fields, separated by spaces.
+// with in.quoted_values, spaces within double quotes don't separate fields, so that a tag value
+// like desc="hello world" can contain spaces. within quotes, a backslash escapes the next character,
+// so \" is a literal quote, and \\ a literal backslash. lines with unbalanced quotes are invalid.
+func splitLine(str string) ([]string, error) {
+	if !*in_quoted_values || strings.IndexByte(str, '"') < 0 {
+		return strings.Split(str, " "), nil
+	}
+	var elements []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(str); i++ {
+		switch {
+		case quoted && str[i] == '\\':
+			i++ // skip the escaped character
+		case str[i] == '"':
+			quoted = !quoted
+		case !quoted && str[i] == ' ':
+			elements = append(elements, str[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unbalanced quotes in line '%s'", str)
+	}
+	return append(elements, str[start:]), nil
+}
+
+// splitRecords splits a line that packs several "metric value ts" records, separated by sep (see in.line_splitter),
+// into one newline terminated line per record. empty records, like the one after a trailing separator, are skipped
+// and only counted.
+// note that sep also splits quoted tag values (see splitLine).
+// buf is left as is: with out.tee_raw we forward it too.
+func splitRecords(buf []byte, sep string) (records [][]byte, empty int) {
+	for _, rec := range bytes.Split(buf, []byte(sep)) {
+		rec = bytes.TrimSpace(rec)
+		if len(rec) == 0 {
+			empty++
+			continue
+		}
+		// appending to rec itself could overwrite what comes after it in buf
+		line := make([]byte, len(rec), len(rec)+1)
+		copy(line, rec)
+		records = append(records, append(line, '\n'))
+	}
+	return records, empty
+}
+
+// unquote returns the content of a double quoted tag value, with the escapes undone.
+// values that aren't quoted are returned as is.
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	v = v[1 : len(v)-1]
+	if strings.IndexByte(v, '\\') < 0 {
+		return v
+	}
+	out := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+1 < len(v) {
+			i++
+		}
+		out = append(out, v[i])
+	}
+	return string(out)
+}
+
+// a timestamp in seconds has 10 digits (until 2286). one with this many digits is in milliseconds (or plain broken)
+const millisDigits = 13
+
+// normalizeTimestamp makes sure a timestamp is in seconds, as carbon expects, based on parse.timestamp_unit:
+// * none: timestamps are left alone, whatever they look like
+// * seconds: all timestamps should be in seconds, the ones that look like milliseconds are rejected
+// * millis: all timestamps are in milliseconds, and get converted
+// * auto: the ones that look like milliseconds get converted
+// it returns the timestamp to use, and whether that's a conversion.
+// only timestamps that are plain integers are considered, others (like carbon's -1 for "now") are left alone.
+func normalizeTimestamp(ts string) (string, bool, error) {
+	for i := 0; i < len(ts); i++ {
+		if ts[i] < '0' || ts[i] > '9' {
+			return ts, false, nil
+		}
+	}
+	millis := len(ts) >= millisDigits
+	switch *parse_timestamp_unit {
+	case "none":
+		return ts, false, nil
+	case "seconds":
+		if millis {
+			return ts, false, fmt.Errorf("timestamp '%s' looks like milliseconds, but parse.timestamp_unit is seconds", ts)
+		}
+		return ts, false, nil
+	case "auto":
+		if !millis {
+			return ts, false, nil
+		}
+	}
+	if len(ts) <= 3 {
+		return "0", true, nil
+	}
+	return ts[:len(ts)-3], true, nil
+}
+
+// parseTagBasedMetric checks the nodes of a proto2 metric_id and parses it into a MetricSpec
+// empty nodes (leading, trailing or double dots) are either trimmed or cause the metric to be rejected,
+// depending on parse.trim_empty_nodes. metrics without a unit tag get parse.default_unit, if set,
+// which (like the trimming) changes the metric id. defaultUnit tells whether that happened, so that the
+// caller can count it: not all callers process the metric for real (see shadow.go and dryrun.go).
+func parseTagBasedMetric(metric_id string) (metric *m20.MetricSpec, defaultUnit bool, err error) {
+	nodes := strings.Split(metric_id, *parse_node_separator)
+	if hasEmptyNode(nodes) {
+		if !*parse_trim_empty_nodes {
+			return nil, false, rejection{&in_metrics_proto2_empty_node_total, fmt.Sprintf("metric '%s' has an empty node", metric_id)}
+		}
+		nodes = trimEmptyNodes(nodes)
+		metric_id = strings.Join(nodes, *parse_node_separator)
+	}
+	if *parse_require_all_tagged && untaggedNodes(nodes) > 0 {
+		return nil, false, rejection{&in_metrics_proto2_untagged_node_total, fmt.Sprintf("metric '%s' has nodes that are not key=val or key_is_val tags", metric_id)}
+	}
+	if *parse_max_positional > 0 {
+		if n := untaggedNodes(nodes); n > *parse_max_positional {
+			return nil, false, rejection{&in_metrics_proto2_too_positional_total, fmt.Sprintf("metric '%s' has %d nodes that are not key=val or key_is_val tags, more than parse.max_positional_tags", metric_id, n)}
+		}
+	}
+	if *parse_default_unit != "" && !hasUnitTag(nodes) {
+		nodes = append(nodes, "unit="+*parse_default_unit)
+		metric_id = strings.Join(nodes, *parse_node_separator)
+		defaultUnit = true
+	}
+	// m20 only knows about dots. with another separator, we hand it the nodes joined by dots,
+	// which only works if none of them contain a dot themselves.
+	m20_id := metric_id
+	if *parse_node_separator != "." {
+		for _, node := range nodes {
+			if strings.Contains(node, ".") {
+				return nil, false, fmt.Errorf("metric '%s' has a node with a dot, which isn't supported with parse.node_separator '%s'", metric_id, *parse_node_separator)
+			}
+		}
+		m20_id = strings.Join(nodes, ".")
+	}
+	metric, err = m20.NewMetricSpec(m20_id)
+	if err != nil {
+		return nil, false, err
+	}
+	metric.Id = metric_id
+	if *in_quoted_values {
+		for key, value := range metric.Tags {
+			metric.Tags[key] = unquote(value)
+		}
+	}
+	if tag_key_pattern != nil {
+		for key := range metric.Tags {
+			if !tag_key_pattern.MatchString(key) {
+				return nil, false, rejection{&in_metrics_proto2_invalid_tag_key_total, fmt.Sprintf("metric '%s' has invalid tag key '%s'", metric_id, key)}
+			}
+		}
+	}
+	// we do the unit rewriting ourselves, based on the unit as it was submitted
+	unit, isRate := rewriteUnit(unitValue(nodes))
+	metric.Tags["unit"] = unit
+	if *parse_ps_adds_rate_tag && isRate {
+		addRateTag(metric)
+	}
+	return metric, defaultUnit, nil
+}
+
+// unitRewrite is a rate suffix of a unit (like "ps") and what it means (like "/s")
+type unitRewrite struct {
+	suffix      string
+	replacement string
+}
+
+var (
+	tag_key_pattern *regexp.Regexp // nil if tag keys aren't validated
+
+	unit_rewrites   []unitRewrite // longest suffix first
+	unit_exceptions map[string]bool
+)
+
+// checkNodeSeparator validates parse.node_separator, and whether it goes with the unit rewrites:
+// rewriting to units like "/s" is only useful because graphite treats slashes as delimiters.
+// if slashes are our delimiters as well, that's ambiguous, so we'd rather have the operator sort it out.
+func checkNodeSeparator(sep string) error {
+	if len(sep) != 1 || strings.ContainsAny(sep, " =_\"\\") {
+		return fmt.Errorf("invalid parse.node_separator '%s', should be a single character, but not a space, '=', '_', '\"' or '\\'", sep)
+	}
+	if sep == "/" {
+		for _, r := range unit_rewrites {
+			if strings.Contains(r.replacement, "/") {
+				return fmt.Errorf("parse.node_separator '/' conflicts with parse.unit_rewrites '%s:%s'. set parse.unit_rewrites without slashes", r.suffix, r.replacement)
+			}
+		}
+	}
+	return nil
+}
+
+// initUnitRewrites sets up the unit rewriting based on parse.unit_rewrites (like "ps:/s,pm:/m")
+// and parse.unit_rewrite_exceptions (like "Steps")
+func initUnitRewrites(rewrites, exceptions string) error {
+	unit_rewrites = nil
+	for _, spec := range strings.Split(rewrites, ",") {
+		if spec == "" {
+			continue
+		}
+		r := strings.SplitN(spec, ":", 2)
+		if len(r) != 2 || r[0] == "" {
+			return fmt.Errorf("invalid unit rewrite '%s', should be suffix:replacement", spec)
+		}
+		unit_rewrites = append(unit_rewrites, unitRewrite{r[0], r[1]})
+	}
+	sort.Sort(bySuffixLen(unit_rewrites))
+	unit_exceptions = make(map[string]bool)
+	for _, unit := range strings.Split(exceptions, ",") {
+		if unit != "" {
+			unit_exceptions[unit] = true
+		}
+	}
+	return nil
+}
+
+type bySuffixLen []unitRewrite
+
+func (r bySuffixLen) Len() int           { return len(r) }
+func (r bySuffixLen) Less(i, j int) bool { return len(r[i].suffix) > len(r[j].suffix) }
+func (r bySuffixLen) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// rewriteUnit replaces the longest matching rate suffix of a unit, e.g. "Errps" -> "Err/s",
+// and returns whether it did. what's left of the unit must look like a metrics 2.0 unit, which are capitalized
+// (like "B", "Err", "Mb", "Req"), so words that happen to end in a suffix (like "maps", "steps") are left alone.
+// so are the exceptions, for the capitalized ones.
+func rewriteUnit(unit string) (string, bool) {
+	if unit_exceptions[unit] || unit == "" || unit[0] < 'A' || unit[0] > 'Z' {
+		return unit, false
+	}
+	for _, r := range unit_rewrites {
+		if len(unit) > len(r.suffix) && strings.HasSuffix(unit, r.suffix) {
+			return unit[:len(unit)-len(r.suffix)] + r.replacement, true
+		}
+	}
+	return unit, false
+}
+
+// hasUnitTag returns whether one of the nodes is a unit tag
+func hasUnitTag(nodes []string) bool {
+	for _, node := range nodes {
+		if strings.HasPrefix(node, "unit=") || strings.HasPrefix(node, "unit_is_") {
+			return true
+		}
+	}
+	return false
+}
+
+// unitValue returns the value of the unit tag in the nodes, or "" if there is none
+func unitValue(nodes []string) string {
+	for _, node := range nodes {
+		var value string
+		if strings.HasPrefix(node, "unit=") {
+			value = node[5:]
+		} else if strings.HasPrefix(node, "unit_is_") {
+			value = node[8:]
+		} else {
+			continue
+		}
+		// like the other tag values
+		if *in_quoted_values {
+			value = unquote(value)
+		}
+		return value
+	}
+	return ""
+}
+
+// addRateTag marks the metric as a rate using the configured parse.rate_tag,
+// unless the metric already explicitly sets that tag key.
+// the tag only goes into the tags, the metric id is left alone so it keeps matching what carbon stores.
+func addRateTag(metric *m20.MetricSpec) {
+	kv := strings.SplitN(*parse_rate_tag, "=", 2) // validated at startup
+	if _, ok := metric.Tags[kv[0]]; !ok {
+		metric.Tags[kv[0]] = kv[1]
+	}
+}
+
+// untaggedNodes returns how many nodes are old-style values, which would get a positional nX tag key
+func untaggedNodes(nodes []string) int {
+	n := 0
+	for _, node := range nodes {
+		if !strings.Contains(node, "=") && !strings.Contains(node, "_is_") {
+			n++
+		}
+	}
+	return n
+}
+
+// isProto2 returns whether a metric id is to be treated as proto2, when we're auto-detecting the protocol.
+// normally that requires a unit tag. with parse.default_unit, we can add the unit, so a metric without one
+// is proto2 too if all its nodes are tags, and it has the target_type tag that metrics 2.0 requires as well.
+// (anything less and ordinary proto1 ids like "app.this_is_fine" would end up rejected as invalid proto2)
+func isProto2(metric_id string) bool {
+	if m20.IsMetric20(metric_id) {
+		return true
+	}
+	if *parse_default_unit == "" {
+		return false
+	}
+	targetType := false
+	for _, node := range strings.Split(metric_id, *parse_node_separator) {
+		if node == "" {
+			continue
+		}
+		if !strings.Contains(node, "=") && !strings.Contains(node, "_is_") {
+			return false
+		}
+		if strings.HasPrefix(node, "target_type=") || strings.HasPrefix(node, "target_type_is_") {
+			targetType = true
+		}
+	}
+	return targetType
+}
+
+// the tag keys most metrics 2.0 metrics have, see https://github.com/vimeo/graph-explorer/wiki/Consistent-tag-keys-and-values
+var commonTagKeys = []string{"unit", "what", "target_type", "mtype", "type", "direction"}
+
+// looksLikeProto2Typo guesses whether a metric id that made it to the proto1 path was meant to be proto2,
+// but its sender got the delimiter wrong. that's a node that starts with one of the common tag keys, followed by
+// "_is" without the trailing underscore, at the end of the node or before something that looks like a unit
+// (a capital or a digit, like "unit_isB" or "what_is"), or followed by a colon (like "unit:B").
+// plain words that happen to start like that, like "type_issues", "unit_isolation" or "unit-tests", don't count.
+func looksLikeProto2Typo(metric_id string) bool {
+	for _, node := range strings.Split(metric_id, *parse_node_separator) {
+		for _, key := range commonTagKeys {
+			if !strings.HasPrefix(node, key) {
+				continue
+			}
+			rest := node[len(key):]
+			if rest == "_is" {
+				return true
+			}
+			if len(rest) > 3 && strings.HasPrefix(rest, "_is") && (rest[3] >= 'A' && rest[3] <= 'Z' || rest[3] >= '0' && rest[3] <= '9') {
+				return true
+			}
+			if len(rest) > 1 && rest[0] == ':' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasEmptyNode(nodes []string) bool {
+	for _, node := range nodes {
+		if node == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// trimEmptyNodes removes empty nodes in place
+func trimEmptyNodes(nodes []string) []string {
+	trimmed := nodes[:0]
+	for _, node := range nodes {
+		if node != "" {
+			trimmed = append(trimmed, node)
+		}
+	}
+	return trimmed
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	m20 "github.com/metrics20/go-metrics20"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var emptyNodeCases = []struct {
+	id      string
+	trimmed string
+}{
+	{".unit=B.target_type=gauge.what=foo", "unit=B.target_type=gauge.what=foo"},                   // leading dot
+	{"unit=B.target_type=gauge.what=foo.", "unit=B.target_type=gauge.what=foo"},                   // trailing dot
+	{"unit=B..target_type=gauge.what=foo", "unit=B.target_type=gauge.what=foo"},                   // double dot
+	{"..unit=B...target_type=gauge.what=foo..", "unit=B.target_type=gauge.what=foo"},              // all of the above
+	{"unit_is_B.target_type_is_gauge..what_is_foo", "unit_is_B.target_type_is_gauge.what_is_foo"}, // also with _is_
+}
+
+func TestParseTagBasedMetricRejectsEmptyNodes(t *testing.T) {
+	defer setBool(parse_trim_empty_nodes, false)()
+	for _, c := range emptyNodeCases {
+		metric, _, err := parseTagBasedMetric(c.id)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %v", c.id, metric)
+			continue
+		}
+		r, ok := err.(rejection)
+		if !ok || r.reason != &in_metrics_proto2_empty_node_total {
+			t.Errorf("%s: expected an empty node rejection, got %q", c.id, err)
+		}
+	}
+}
+
+func TestParseTagBasedMetricTrimsEmptyNodes(t *testing.T) {
+	defer setBool(parse_trim_empty_nodes, true)()
+	for _, c := range emptyNodeCases {
+		metric, _, err := parseTagBasedMetric(c.id)
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.id, err)
+			continue
+		}
+		if metric.Id != c.trimmed {
+			t.Errorf("%s: expected id %s, got %s", c.id, c.trimmed, metric.Id)
+		}
+		for key, value := range metric.Tags {
+			if value == "" {
+				t.Errorf("%s: tag %s has an empty value", c.id, key)
+			}
+		}
+		if len(metric.Tags) != 3 {
+			t.Errorf("%s: expected 3 tags, got %v", c.id, metric.Tags)
+		}
+	}
+}
+
+func TestParseTagBasedMetricRateTag(t *testing.T) {
+	defer setString(parse_rate_tag, "mtype=rate")()
+	cases := []struct {
+		id      string
+		enabled bool
+		unit    string
+		mtype   string // "" for no mtype tag
+	}{
+		{"unit=Errps.target_type=gauge.what=foo", false, "Err/s", ""},
+		{"unit=Errps.target_type=gauge.what=foo", true, "Err/s", "rate"},
+		{"unit_is_Reqpm.target_type_is_gauge.what_is_foo", true, "Req/m", "rate"},
+		{"unit=Errps.target_type=gauge.mtype=count.what=foo", true, "Err/s", "count"}, // the sender's own tag wins
+		{"unit=B.target_type=gauge.what=foo", true, "B", ""},
+	}
+	for _, c := range cases {
+		restore := setBool(parse_ps_adds_rate_tag, c.enabled)
+		metric, _, err := parseTagBasedMetric(c.id)
+		restore()
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.id, err)
+			continue
+		}
+		if metric.Tags["unit"] != c.unit {
+			t.Errorf("%s: expected unit %s, got %s", c.id, c.unit, metric.Tags["unit"])
+		}
+		if metric.Tags["mtype"] != c.mtype {
+			t.Errorf("%s (rate tag %v): expected mtype '%s', got '%s'", c.id, c.enabled, c.mtype, metric.Tags["mtype"])
+		}
+		// the id is what carbon stores the metric as, so it must not change
+		if metric.Id != c.id {
+			t.Errorf("%s: id changed to %s", c.id, metric.Id)
+		}
+	}
+}
+
+func TestRewriteUnit(t *testing.T) {
+	cases := []struct {
+		unit      string
+		rewritten string
+	}{
+		{"Errps", "Err/s"},
+		{"Mbps", "Mb/s"},
+		{"Reqpm", "Req/m"},
+		{"Jobph", "Job/h"},
+		{"B", "B"},
+		{"ps", "ps"}, // the suffix on its own isn't a rate
+		{"Pps", "P/s"},
+		// words that just end in a suffix
+		{"maps", "maps"},
+		{"laps", "laps"},
+		{"steps", "steps"},
+		{"graphs", "graphs"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		got, rewritten := rewriteUnit(c.unit)
+		if got != c.rewritten || rewritten != (c.unit != c.rewritten) {
+			t.Errorf("%s: expected %s, got %s (rewritten: %v)", c.unit, c.rewritten, got, rewritten)
+		}
+	}
+}
+
+func TestRewriteUnitLongestSuffix(t *testing.T) {
+	defer initUnitRewrites(*parse_unit_rewrites, *parse_unit_exceptions)
+	err := initUnitRewrites("s:/s,ps:/s,ms:_per_ms", "Steps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		unit      string
+		rewritten string
+	}{
+		{"Errps", "Err/s"}, // not "Errp/s"
+		{"Reqms", "Req_per_ms"},
+		{"Reqs", "Req/s"},
+		{"Steps", "Steps"},
+	}
+	for _, c := range cases {
+		if got, _ := rewriteUnit(c.unit); got != c.rewritten {
+			t.Errorf("%s: expected %s, got %s", c.unit, c.rewritten, got)
+		}
+	}
+}
+
+func TestParseTagBasedMetricTagKeyPattern(t *testing.T) {
+	cases := []struct {
+		id string
+		ok bool
+	}{
+		{"unit=B.target_type=gauge.what=foo", true},
+		{"unit=B.target_type=gauge.what-ever=foo.what_ever=bar", true},
+		{"servers.web1.unit=B.target_type=gauge", true}, // positional nodes get keys like n1, which are fine
+		{"unit=B.target_type=gauge.1what=foo", false},
+		{"unit=B.target_type=gauge.@host=web1", false},
+		{"unit=B.target_type=gauge.#what=foo", false},
+	}
+	for _, c := range cases {
+		_, _, err := parseTagBasedMetric(c.id)
+		checkTagKeyRejection(t, c.id, c.ok, err)
+	}
+}
+
+// with quoted values, a key can have a space, if the sender quotes it
+func TestParseTagBasedMetricTagKeyWithSpace(t *testing.T) {
+	defer setBool(in_quoted_values, true)()
+	line := `unit=B.target_type=gauge."my key"=foo 1 1400000000`
+	l, err := checkLine([]byte(line + "\n"))
+	if err != nil {
+		t.Fatalf("%s: unexpected error %q", line, err)
+	}
+	if l.elements[0] != `unit=B.target_type=gauge."my key"=foo` {
+		t.Fatalf("%s: unexpected metric id %s", line, l.elements[0])
+	}
+	_, _, err = parseTagBasedMetric(l.elements[0])
+	checkTagKeyRejection(t, l.elements[0], false, err)
+}
+
+func checkTagKeyRejection(t *testing.T, id string, ok bool, err error) {
+	if ok {
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", id, err)
+		}
+		return
+	}
+	r, isRejection := err.(rejection)
+	if !isRejection || r.reason != &in_metrics_proto2_invalid_tag_key_total {
+		t.Errorf("%s: expected an invalid tag key rejection, got %v", id, err)
+	}
+}
+
+func TestSplitLineQuoted(t *testing.T) {
+	defer setBool(in_quoted_values, true)()
+	cases := []struct {
+		line     string
+		elements []string // nil if the line is invalid
+	}{
+		{`foo.bar 1 2`, []string{"foo.bar", "1", "2"}},
+		{`desc="hello world".unit=B 1 2`, []string{`desc="hello world".unit=B`, "1", "2"}},
+		{`desc="say \"hi there\"".unit=B 1 2`, []string{`desc="say \"hi there\"".unit=B`, "1", "2"}},
+		{`desc="back\\slash ".unit=B 1 2`, []string{`desc="back\\slash ".unit=B`, "1", "2"}},
+		{`desc="hello world.unit=B 1 2`, nil},
+		{`desc="hello \".unit=B 1 2`, nil}, // the escaped quote doesn't close it
+	}
+	for _, c := range cases {
+		elements, err := splitLine(c.line)
+		if c.elements == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", c.line, elements)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.line, err)
+			continue
+		}
+		if strings.Join(elements, "|") != strings.Join(c.elements, "|") {
+			t.Errorf("%s: expected %q, got %q", c.line, c.elements, elements)
+		}
+	}
+}
+
+func TestParseTagBasedMetricQuotedValues(t *testing.T) {
+	defer setBool(in_quoted_values, true)()
+	cases := []struct {
+		line string
+		tags map[string]string
+	}{
+		{`desc="hello world".unit=B.target_type=gauge 1 2`, map[string]string{"desc": "hello world", "unit": "B", "target_type": "gauge"}},
+		{`desc="hello world".unit="B".target_type=gauge 1 2`, map[string]string{"desc": "hello world", "unit": "B", "target_type": "gauge"}},
+		{`desc="hello world".unit_is_"Errps".target_type=gauge 1 2`, map[string]string{"desc": "hello world", "unit": "Err/s", "target_type": "gauge"}},
+		{`desc="say \"hi\"".unit=B.target_type=gauge 1 2`, map[string]string{"desc": `say "hi"`, "unit": "B", "target_type": "gauge"}},
+	}
+	for _, c := range cases {
+		l, err := checkLine([]byte(c.line + "\n"))
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.line, err)
+			continue
+		}
+		metric, _, err := parseTagBasedMetric(l.elements[0])
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(metric.Tags, c.tags) {
+			t.Errorf("%s: expected tags %v, got %v", c.line, c.tags, metric.Tags)
+		}
+		if metric.Id != l.elements[0] {
+			t.Errorf("%s: id changed to %s", c.line, metric.Id)
+		}
+	}
+	if _, err := checkLine([]byte(`desc="hello world.unit=B.target_type=gauge 1 2` + "\n")); err == nil {
+		t.Errorf("expected a line with unbalanced quotes to be rejected")
+	}
+}
+
+func TestParseTagBasedMetricRequireAllTagged(t *testing.T) {
+	cases := []struct {
+		id string
+		ok bool // with parse.require_all_tagged
+	}{
+		{"unit=B.target_type=gauge.what=foo", true},
+		{"unit_is_B.target_type_is_gauge.what_is_foo", true},
+		{"servers.web1.unit=B.target_type=gauge", false},
+		{"unit=B.target_type=gauge.foo", false},
+	}
+	for _, c := range cases {
+		// without the option, positional nodes are fine
+		if _, _, err := parseTagBasedMetric(c.id); err != nil {
+			t.Errorf("%s: unexpected error %q", c.id, err)
+		}
+		restore := setBool(parse_require_all_tagged, true)
+		metric, _, err := parseTagBasedMetric(c.id)
+		restore()
+		if c.ok {
+			if err != nil {
+				t.Errorf("%s: unexpected error %q", c.id, err)
+			}
+			continue
+		}
+		r, ok := err.(rejection)
+		if !ok || r.reason != &in_metrics_proto2_untagged_node_total {
+			t.Errorf("%s: expected an untagged node rejection, got %v, %v", c.id, metric, err)
+		}
+	}
+}
+
+func TestParseTagBasedMetricMaxPositionalTags(t *testing.T) {
+	cases := []struct {
+		max int
+		id  string
+		ok  bool
+	}{
+		// 0 means no limit
+		{0, "a.b.c.d.unit=B.target_type=gauge", true},
+		{2, "unit=B.target_type=gauge.what=foo", true},
+		{2, "servers.unit=B.target_type=gauge", true},
+		{2, "servers.web1.unit=B.target_type=gauge", true}, // right at the limit
+		{2, "servers.web1.cpu.unit=B.target_type=gauge", false},
+		{2, "servers.web1.unit_is_B.target_type_is_gauge", true},
+		{2, "servers.web1.cpu.unit_is_B.target_type_is_gauge", false},
+		{1, "servers.unit=B.target_type=gauge", true},
+		{1, "servers.web1.unit=B.target_type=gauge", false},
+	}
+	for _, c := range cases {
+		restore := setInt(parse_max_positional, c.max)
+		metric, _, err := parseTagBasedMetric(c.id)
+		restore()
+		if c.ok {
+			if err != nil {
+				t.Errorf("max %d, %s: unexpected error %q", c.max, c.id, err)
+			}
+			continue
+		}
+		r, ok := err.(rejection)
+		if !ok || r.reason != &in_metrics_proto2_too_positional_total {
+			t.Errorf("max %d, %s: expected a too many positional tags rejection, got %v, %v", c.max, c.id, metric, err)
+		}
+	}
+}
+
+func TestLooksLikeProto2Typo(t *testing.T) {
+	cases := []struct {
+		id   string
+		typo bool
+	}{
+		{"servers.web1.cpu", false},
+		{"servers.web1.unit_isB", true},
+		{"servers.web1.what_is", true},
+		{"target_type_is.servers", true},
+		{"servers.web1.unit_is5", true},
+		{"servers.unit:B", true},
+		{"servers.unit:", false},
+		// lower case after "_is" is more likely a word than a value
+		{"target_type_isgauge.servers", false},
+		// a dash is an ordinary character in proto1 names
+		{"servers.unit-B", false},
+		{"unit-tests.duration", false},
+		{"servers.unit", false},
+		// "_is" in plain words
+		{"servers.web1.disk_isolation", false},
+		{"app.cpu_issues", false},
+		{"type_issues.count", false},
+		{"unit_isolation.count", false},
+		{"app.this_is_fine", false},
+		{"app.unitis", false},
+		{"app.units", false},
+		{"app.whatever", false},
+	}
+	for _, c := range cases {
+		if typo := looksLikeProto2Typo(c.id); typo != c.typo {
+			t.Errorf("%s: expected %v, got %v", c.id, c.typo, typo)
+		}
+	}
+}
+
+func TestProcessInputLinesCountsTypos(t *testing.T) {
+	defer setBool(parse_detect_typos, true)()
+	typos := in_metrics_proto2_typo_total.val.Count()
+	p1, _ := processLines(
+		inLine{buf: []byte("servers.web1.unit_isB 1 1400000000\n"), proto: protoAuto},
+		inLine{buf: []byte("servers.web1.disk_isolation 1 1400000000\n"), proto: protoAuto},
+	)
+	if len(p1) != 2 {
+		t.Errorf("expected both to be treated as proto1, got %v", p1)
+	}
+	if n := in_metrics_proto2_typo_total.val.Count() - typos; n != 1 {
+		t.Errorf("expected 1 suspected typo, got %d", n)
+	}
+}
+
+func TestParseTagBasedMetricNodeSeparator(t *testing.T) {
+	cases := []struct {
+		sep  string
+		id   string
+		tags map[string]string // nil if it's rejected
+	}{
+		{":", "unit=B:target_type=gauge:what=foo", map[string]string{"unit": "B", "target_type": "gauge", "what": "foo"}},
+		{":", "unit_is_Errps:target_type_is_gauge:servers", map[string]string{"unit": "Err/s", "target_type": "gauge", "n3": "servers"}},
+		{":", "unit=B:target_type=gauge:host=web1.example.com", nil}, // m20 would split on the dot
+		{"/", "unit=B/target_type=gauge/what=foo", map[string]string{"unit": "B", "target_type": "gauge", "what": "foo"}},
+		{"/", "unit=B/target_type=gauge/what=foo.bar", nil},
+	}
+	for _, c := range cases {
+		restore := setString(parse_node_separator, c.sep)
+		metric, _, err := parseTagBasedMetric(c.id)
+		restore()
+		if c.tags == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", c.id, metric.Tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %q", c.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(metric.Tags, c.tags) {
+			t.Errorf("%s: expected tags %v, got %v", c.id, c.tags, metric.Tags)
+		}
+		if metric.Id != c.id {
+			t.Errorf("%s: id changed to %s", c.id, metric.Id)
+		}
+	}
+}
+
+func TestParseTagBasedMetricNodeSeparatorTrims(t *testing.T) {
+	defer setString(parse_node_separator, ":")()
+	defer setBool(parse_trim_empty_nodes, true)()
+	metric, _, err := parseTagBasedMetric(":unit=B::target_type=gauge:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the id is put back together with the same separator
+	if metric.Id != "unit=B:target_type=gauge" {
+		t.Errorf("expected id unit=B:target_type=gauge, got %s", metric.Id)
+	}
+}
+
+func TestCheckNodeSeparator(t *testing.T) {
+	cases := []struct {
+		sep      string
+		rewrites string
+		ok       bool
+	}{
+		{".", "ps:/s", true},
+		{":", "ps:/s", true},
+		{"/", "ps:/s,pm:/m", false}, // the rewritten units would have our separator in them
+		{"/", "ps:_per_s", true},
+		{"", "", false},
+		{"::", "", false},
+		{" ", "", false},
+		{"=", "", false},
+		{"_", "", false},
+	}
+	defer initUnitRewrites(*parse_unit_rewrites, *parse_unit_exceptions)
+	for _, c := range cases {
+		if err := initUnitRewrites(c.rewrites, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkNodeSeparator(c.sep); (err == nil) != c.ok {
+			t.Errorf("'%s' with rewrites %s: expected ok to be %v, got %v", c.sep, c.rewrites, c.ok, err)
+		}
+	}
+}
+
+func TestParseTagBasedMetricDefaultUnit(t *testing.T) {
+	cases := []struct {
+		id          string
+		defUnit     string
+		parsedId    string // "" if it's rejected
+		unit        string
+		defaultUnit bool
+	}{
+		{"unit=B.target_type=gauge.what=foo", "", "unit=B.target_type=gauge.what=foo", "B", false},
+		{"unit=B.target_type=gauge.what=foo", "unknown", "unit=B.target_type=gauge.what=foo", "B", false},
+		{"unit_is_B.target_type=gauge.what=foo", "unknown", "unit_is_B.target_type=gauge.what=foo", "B", false},
+		{"target_type=gauge.what=foo", "unknown", "target_type=gauge.what=foo.unit=unknown", "unknown", true},
+		{"target_type=gauge.what=foo", "", "", "", false},
+	}
+	for _, c := range cases {
+		restore := setString(parse_default_unit, c.defUnit)
+		metric, defaultUnit, err := parseTagBasedMetric(c.id)
+		restore()
+		if c.parsedId == "" {
+			if err == nil {
+				t.Errorf("%s (default '%s'): expected an error, got %v", c.id, c.defUnit, metric)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s (default '%s'): unexpected error %q", c.id, c.defUnit, err)
+			continue
+		}
+		if metric.Id != c.parsedId || metric.Tags["unit"] != c.unit || defaultUnit != c.defaultUnit {
+			t.Errorf("%s (default '%s'): expected %s with unit %s (default unit %v), got %s with unit %s (%v)",
+				c.id, c.defUnit, c.parsedId, c.unit, c.defaultUnit, metric.Id, metric.Tags["unit"], defaultUnit)
+		}
+	}
+}
+
+// only the metrics we actually process count, not the shadow parse or a dry run
+func TestDefaultUnitCounting(t *testing.T) {
+	defer setString(parse_default_unit, "unknown")()
+	defer setBool(parse_shadow, true)()
+	defer func(old func(string) (*m20.MetricSpec, error)) { candidateParser = old }(candidateParser)
+	candidateParser = func(metric_id string) (*m20.MetricSpec, error) {
+		metric, _, err := parseTagBasedMetric(metric_id)
+		return metric, err
+	}
+	applied := in_default_unit_total.val.Count()
+	_, p2 := processLines(
+		inLine{buf: []byte("target_type=gauge.what=foo 1 1400000000\n"), proto: protoAuto},
+		inLine{buf: []byte("unit=B.target_type=gauge.what=bar 1 1400000000\n"), proto: protoAuto},
+	)
+	if len(p2) != 2 {
+		t.Errorf("expected 2 proto2 metrics, got %v", p2)
+	}
+	if res := dryRun([]byte("target_type=gauge.what=baz 1 1400000000\n"), protoAuto); !res.Accepted {
+		t.Errorf("expected the dry run to accept the metric, got %v", res)
+	}
+	if n := in_default_unit_total.val.Count() - applied; n != 1 {
+		t.Errorf("expected the default unit to be counted once, got %d", n)
+	}
+}
+
+func TestIsProto2DefaultUnit(t *testing.T) {
+	defer setString(parse_default_unit, "unknown")()
+	cases := []struct {
+		id     string
+		proto2 bool
+	}{
+		{"unit=B.target_type=gauge.what=foo", true},
+		{"target_type=gauge.what=foo", true},
+		{"target_type_is_gauge.what_is_foo", true},
+		{"target_type=gauge..what=foo", true}, // leave the empty node to parseTagBasedMetric
+		// proto1 ids that happen to have "_is_" or "=" in them stay proto1
+		{"app.this_is_fine.count", false},
+		{"servers.web1.target_type=gauge.what=foo", false},
+		{"what=foo.server=web1", false}, // without target_type, it would be rejected anyway
+	}
+	for _, c := range cases {
+		if proto2 := isProto2(c.id); proto2 != c.proto2 {
+			t.Errorf("%s: expected proto2 %v, got %v", c.id, c.proto2, proto2)
+		}
+	}
+
+	// and the proto1 one still gets indexed as such
+	p1, p2 := processLines(inLine{buf: []byte("app.this_is_fine.count 1 1400000000\n"), proto: protoAuto})
+	if len(p1) != 1 || p1[0] != "app.this_is_fine.count" || len(p2) != 0 {
+		t.Errorf("expected app.this_is_fine.count to be indexed as proto1, got %v and %v", p1, p2)
+	}
+}
+
+func TestNormalizeTimestamp(t *testing.T) {
+	cases := []struct {
+		unit      string
+		ts        string
+		expected  string
+		converted bool
+		rejected  bool
+	}{
+		{"none", "1400000000", "1400000000", false, false},
+		{"none", "1400000000123", "1400000000123", false, false},
+		{"seconds", "1400000000", "1400000000", false, false},
+		{"seconds", "1400000000123", "", false, true},
+		{"millis", "1400000000", "1400000", true, false},
+		{"millis", "1400000000123", "1400000000", true, false},
+		{"auto", "1400000000", "1400000000", false, false},
+		{"auto", "1400000000123", "1400000000", true, false},
+		// not plain integers, so left alone in any mode
+		{"millis", "-1", "-1", false, false},
+		{"seconds", "1400000000123.5", "1400000000123.5", false, false},
+	}
+	for _, c := range cases {
+		restore := setString(parse_timestamp_unit, c.unit)
+		line := "foo.bar 1 " + c.ts + "\n"
+		l, err := checkLine([]byte(line))
+		restore()
+		if c.rejected {
+			if r, ok := err.(rejection); !ok || r.reason != &in_lines_bad_ts_total {
+				t.Errorf("%s %s: expected an invalid timestamp rejection, got %v", c.unit, c.ts, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error %q", c.unit, c.ts, err)
+			continue
+		}
+		if l.elements[2] != c.expected || l.tsConverted != c.converted {
+			t.Errorf("%s %s: expected timestamp %s (converted: %v), got %s (%v)", c.unit, c.ts, c.expected, c.converted, l.elements[2], l.tsConverted)
+		}
+		if expected := "foo.bar 1 " + c.expected + "\n"; string(l.buf) != expected {
+			t.Errorf("%s %s: expected to forward %q, got %q", c.unit, c.ts, expected, l.buf)
+		}
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	cases := []struct {
+		line    string
+		records []string
+		empty   int
+	}{
+		{"a.b 1 1400000000\n", []string{"a.b 1 1400000000\n"}, 0},
+		{"a.b 1 1400000000;a.c 2 1400000000\n", []string{"a.b 1 1400000000\n", "a.c 2 1400000000\n"}, 0},
+		{"a.b 1 1400000000; a.c 2 1400000000 ;a.d 3 1400000000\r\n", []string{"a.b 1 1400000000\n", "a.c 2 1400000000\n", "a.d 3 1400000000\n"}, 0},
+		// trailing, leading and double delimiters make empty records
+		{"a.b 1 1400000000;a.c 2 1400000000;\n", []string{"a.b 1 1400000000\n", "a.c 2 1400000000\n"}, 1},
+		{";a.b 1 1400000000;;a.c 2 1400000000\n", []string{"a.b 1 1400000000\n", "a.c 2 1400000000\n"}, 2},
+		{";;\n", nil, 3},
+	}
+	for _, c := range cases {
+		buf := []byte(c.line)
+		records, empty := splitRecords(buf, ";")
+		var got []string
+		for _, rec := range records {
+			got = append(got, string(rec))
+		}
+		if !reflect.DeepEqual(got, c.records) || empty != c.empty {
+			t.Errorf("%q: expected records %q and %d empty, got %q and %d", c.line, c.records, c.empty, got, empty)
+		}
+		if string(buf) != c.line {
+			t.Errorf("%q: the line was changed into %q", c.line, buf)
+		}
+	}
+	// a multi-character delimiter
+	records, _ := splitRecords([]byte("a.b 1 1400000000||a.c 2 1400000000\n"), "||")
+	if len(records) != 2 || string(records[1]) != "a.c 2 1400000000\n" {
+		t.Errorf("expected 2 records, got %q", records)
+	}
+}
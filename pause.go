@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// POST /pause on the stats http address makes us stop reading from our clients, e.g. for ES maintenance.
+// connections stay open, so senders just experience TCP backpressure. POST /resume continues where we left off.
+
+type ingestGate struct {
+	paused int32 // 1 when paused. checked before every read, so that's just an atomic load while running
+
+	sync.Mutex
+	resumed chan bool // closed on resume
+}
+
+var ingest = &ingestGate{}
+
+// wait blocks for as long as ingest is paused
+func (g *ingestGate) wait() {
+	if atomic.LoadInt32(&g.paused) == 0 {
+		return
+	}
+	g.Lock()
+	resumed := g.resumed
+	g.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+func (g *ingestGate) pause() {
+	g.Lock()
+	defer g.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan bool)
+		atomic.StoreInt32(&g.paused, 1)
+		in_paused.Update(1)
+	}
+}
+
+func (g *ingestGate) resume() {
+	g.Lock()
+	defer g.Unlock()
+	if g.resumed != nil {
+		atomic.StoreInt32(&g.paused, 0)
+		close(g.resumed)
+		g.resumed = nil
+		in_paused.Update(0)
+	}
+}
+
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ingest.pause()
+	fmt.Println("ingest paused")
+	fmt.Fprintln(w, "paused")
+}
+
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ingest.resume()
+	fmt.Println("ingest resumed")
+	fmt.Fprintln(w, "resumed")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// post sends an empty POST request to the handler
+func post(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", path, nil))
+	return w
+}
+
+func TestPauseResume(t *testing.T) {
+	defer ingest.resume()
+	lines_read = make(chan inLine, 10)
+	proto1_read = make(chan string, 10)
+	defer func() { lines_read, proto1_read = nil, nil }()
+
+	if w := post(pauseHandler, "/pause"); w.Code != http.StatusOK {
+		t.Fatalf("pause: unexpected status %d", w.Code)
+	}
+	if n := in_paused.val.Count(); n != 1 {
+		t.Errorf("expected the paused gauge to be 1, got %d", n)
+	}
+	conn := newMockConn("foo.bar 1 1400000000\nfoo.baz 1 1400000000\n", io.EOF)
+	clientDone, processDone := make(chan bool), make(chan bool)
+	go func() {
+		handleClient(conn, protoAuto)
+		clientDone <- true
+	}()
+	go func() {
+		processInputLines()
+		processDone <- true
+	}()
+	// a line that was read before we paused waits in processInputLines
+	lines_read <- inLine{buf: []byte("foo.early 1 1400000000\n"), proto: protoAuto}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := len(proto1_read); n != 0 {
+		t.Errorf("expected nothing to be processed while paused, got %d metrics", n)
+	}
+	if n := conn.data.Len(); n == 0 {
+		t.Errorf("expected nothing to be read from the connection while paused")
+	}
+	if conn.closed {
+		t.Errorf("expected the connection to stay open while paused")
+	}
+
+	if w := post(resumeHandler, "/resume"); w.Code != http.StatusOK {
+		t.Fatalf("resume: unexpected status %d", w.Code)
+	}
+	if n := in_paused.val.Count(); n != 0 {
+		t.Errorf("expected the paused gauge to be 0, got %d", n)
+	}
+	<-clientDone
+	close(lines_read)
+	<-processDone
+	close(proto1_read)
+	var ids []string
+	for id := range proto1_read {
+		ids = append(ids, id)
+	}
+	if len(ids) != 3 {
+		t.Errorf("expected all 3 metrics to be processed after resuming, got %v", ids)
+	}
+
+	if w := post(pauseHandler, "/pause"); w.Code != http.StatusOK {
+		t.Fatalf("pause: unexpected status %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	pauseHandler(w, httptest.NewRequest("GET", "/pause", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// optional output that forwards the datapoints to a prometheus remote-write endpoint.
+// it gets its own channel from processInputLines, and a goroutine that batches and posts.
+// when the queue is full we drop rather than block, so a slow endpoint can't stall ingest or indexing.
+// the WriteRequest protobuf and the snappy block framing are simple enough that we encode them by hand.
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	labels []promLabel
+	value  float64
+	ts     int64 // in ms
+}
+
+// queuePromSample converts the value and timestamp fields of a line into a sample for the given labels.
+// samples we can't represent are counted as invalid.
+func queuePromSample(labels []promLabel, value, ts string) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		promwrite_invalid_total.Inc(1)
+		return
+	}
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		promwrite_invalid_total.Inc(1)
+		return
+	}
+	sort.Sort(promLabels(labels))
+	// label names must be unique, or the endpoint refuses the whole batch. tags like a-b and a_b end up as the
+	// same label, and a __name__ tag clashes with the name we set. we can't tell which one is meant, so we skip those.
+	for i := 1; i < len(labels); i++ {
+		if labels[i].name == labels[i-1].name {
+			promwrite_invalid_total.Inc(1)
+			return
+		}
+	}
+	select {
+	case promwrite_read <- promSample{labels, v, t * 1000}:
+	default:
+		promwrite_dropped_total.Inc(1)
+	}
+}
+
+// promLabelsProto1 gives the labels for a legacy metric: just the (sanitized) name
+func promLabelsProto1(id string) []promLabel {
+	return []promLabel{{"__name__", promName(id)}}
+}
+
+// promLabelsProto2 gives the labels for a metrics 2.0 metric: one for every tag,
+// plus the name, which is the value of the promwrite.name_tag tag if present, or otherwise the sanitized id.
+func promLabelsProto2(id string, tags map[string]string) []promLabel {
+	labels := make([]promLabel, 0, len(tags)+1)
+	name := promName(id)
+	for k, v := range tags {
+		if k == *promwrite_name_tag {
+			name = promName(v)
+		}
+		labels = append(labels, promLabel{promName(k), v})
+	}
+	return append(labels, promLabel{"__name__", name})
+}
+
+// promName makes a string a valid prometheus metric/label name ([a-zA-Z_][a-zA-Z0-9_]*)
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+type promLabels []promLabel
+
+func (l promLabels) Len() int           { return len(l) }
+func (l promLabels) Less(i, j int) bool { return l[i].name < l[j].name }
+func (l promLabels) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func promWrite() {
+	client := &http.Client{Timeout: time.Duration(*promwrite_timeout) * time.Second}
+	ticker := time.NewTicker(time.Duration(*promwrite_flush_int) * time.Second)
+	batch := make([]promSample, 0, *promwrite_batch_size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := promSend(client, batch)
+		if err != nil {
+			fmt.Printf("WARN could not send %d samples to prometheus remote-write endpoint: %s\n", len(batch), err.Error())
+			promwrite_errors_total.Inc(1)
+			promwrite_dropped_total.Inc(int64(len(batch)))
+		} else {
+			promwrite_sent_total.Inc(int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-promwrite_read:
+			batch = append(batch, s)
+			if len(batch) >= *promwrite_batch_size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-pending_backlog_promwrite.valueReq:
+			pending_backlog_promwrite.valueResp <- int64(len(promwrite_read))
+		}
+	}
+}
+
+// promSend posts the batch, retrying with backoff on network errors and 5xx responses
+func promSend(client *http.Client, batch []promSample) error {
+	body := snappyEncode(promWriteRequest(batch))
+	var err error
+	backoff := time.Second
+	for attempt := 0; attempt <= *promwrite_max_retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var req *http.Request
+		req, err = http.NewRequest("POST", *promwrite_url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("endpoint returned %s", resp.Status)
+		if resp.StatusCode/100 != 5 {
+			return err // retrying won't help
+		}
+	}
+	return err
+}
+
+// promWriteRequest encodes the batch as a prometheus WriteRequest protobuf message, with a TimeSeries per sample
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func promWriteRequest(batch []promSample) []byte {
+	var req, series, msg []byte
+	for _, s := range batch {
+		series = series[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = pbBytes(msg, 1, []byte(l.name))
+			msg = pbBytes(msg, 2, []byte(l.value))
+			series = pbBytes(series, 1, msg)
+		}
+		msg = msg[:0]
+		msg = append(msg, 1<<3|1) // field 1, 64-bit
+		var v [8]byte
+		binary.LittleEndian.PutUint64(v[:], math.Float64bits(s.value))
+		msg = append(msg, v[:]...)
+		msg = append(msg, 2<<3|0) // field 2, varint
+		msg = appendUvarint(msg, uint64(s.ts))
+		series = pbBytes(series, 2, msg)
+		req = pbBytes(req, 1, series)
+	}
+	return req
+}
+
+// pbBytes appends a length-delimited protobuf field
+func pbBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(field<<3|2))
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// snappyEncode wraps data in a snappy block consisting of literals only.
+// that's valid snappy, just without compression, which is fine for our batch sizes.
+func snappyEncode(data []byte) []byte {
+	buf := appendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+		// literal with a 2 byte length
+		buf = append(buf, 61<<2, byte(n-1), byte((n-1)>>8))
+		buf = append(buf, data[:n]...)
+		data = data[n:]
+	}
+	return buf
+}
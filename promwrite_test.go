@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// snappyDecode decodes a snappy block. our encoder only emits literals, so that's all this supports
+func snappyDecode(buf []byte) ([]byte, error) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	buf = buf[l:]
+	var out []byte
+	for len(buf) > 0 {
+		tag := buf[0]
+		if tag&3 != 0 {
+			return nil, fmt.Errorf("unsupported tag %x", tag)
+		}
+		length := int(tag >> 2)
+		buf = buf[1:]
+		if length >= 60 {
+			extra := length - 59
+			if len(buf) < extra {
+				return nil, fmt.Errorf("truncated literal length")
+			}
+			length = 0
+			for i := extra - 1; i >= 0; i-- {
+				length = length<<8 | int(buf[i])
+			}
+			buf = buf[extra:]
+		}
+		length++
+		if len(buf) < length {
+			return nil, fmt.Errorf("truncated literal")
+		}
+		out = append(out, buf[:length]...)
+		buf = buf[length:]
+	}
+	if uint64(len(out)) != n {
+		return nil, fmt.Errorf("decoded %d bytes, header says %d", len(out), n)
+	}
+	return out, nil
+}
+
+type pbField struct {
+	num   int
+	bytes []byte // for length-delimited fields
+	fixed uint64 // for 64-bit fields
+	value uint64 // for varints
+}
+
+// pbFields splits a protobuf message into its fields
+func pbFields(msg []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid key")
+		}
+		msg = msg[n:]
+		f := pbField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.value, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint")
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return nil, fmt.Errorf("truncated fixed64")
+			}
+			f.fixed = binary.LittleEndian.Uint64(msg)
+			msg = msg[8:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return nil, fmt.Errorf("invalid length-delimited field")
+			}
+			f.bytes = msg[n : n+int(l)]
+			msg = msg[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// decodeWriteRequest is the inverse of promWriteRequest
+func decodeWriteRequest(t *testing.T, req []byte) []promSample {
+	series, err := pbFields(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batch []promSample
+	for _, ts := range series {
+		if ts.num != 1 {
+			t.Fatalf("unexpected WriteRequest field %d", ts.num)
+		}
+		fields, err := pbFields(ts.bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s promSample
+		for _, f := range fields {
+			sub, err := pbFields(f.bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch f.num {
+			case 1:
+				if len(sub) != 2 || sub[0].num != 1 || sub[1].num != 2 {
+					t.Fatalf("unexpected Label %v", sub)
+				}
+				s.labels = append(s.labels, promLabel{string(sub[0].bytes), string(sub[1].bytes)})
+			case 2:
+				if len(sub) != 2 || sub[0].num != 1 || sub[1].num != 2 {
+					t.Fatalf("unexpected Sample %v", sub)
+				}
+				s.value = math.Float64frombits(sub[0].fixed)
+				s.ts = int64(sub[1].value)
+			default:
+				t.Fatalf("unexpected TimeSeries field %d", f.num)
+			}
+		}
+		batch = append(batch, s)
+	}
+	return batch
+}
+
+func TestPromWriteRequest(t *testing.T) {
+	batch := []promSample{
+		{[]promLabel{{"__name__", "foo"}, {"unit", "B"}}, 1.5, 1400000000000},
+		{[]promLabel{{"__name__", "servers_web1_cpu"}}, -3, 1400000001000},
+		{[]promLabel{{"__name__", "bar"}, {"desc", strings.Repeat("x", 300)}}, math.MaxFloat64, 0},
+	}
+	body, err := snappyDecode(snappyEncode(promWriteRequest(batch)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decodeWriteRequest(t, body)
+	if !reflect.DeepEqual(got, batch) {
+		t.Errorf("expected %v\ngot %v", batch, got)
+	}
+}
+
+func TestSnappyEncodeLarge(t *testing.T) {
+	// more than the 65536 bytes of a single literal
+	data := []byte(strings.Repeat("0123456789", 20000))
+	got, err := snappyDecode(snappyEncode(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Errorf("decoded data differs from the input")
+	}
+}
+
+func TestQueuePromSampleSkipsDuplicateLabels(t *testing.T) {
+	defer setString(promwrite_name_tag, "what")()
+	promwrite_read = make(chan promSample, 10)
+	defer func() { promwrite_read = nil }()
+	cases := []struct {
+		tags map[string]string
+		ok   bool
+	}{
+		{map[string]string{"unit": "B", "what": "foo", "a-b": "1"}, true},
+		{map[string]string{"unit": "B", "what": "foo", "a-b": "1", "a_b": "2"}, false},
+		{map[string]string{"unit": "B", "what": "foo", "__name__": "bar"}, false},
+	}
+	for _, c := range cases {
+		invalid := promwrite_invalid_total.val.Count()
+		queuePromSample(promLabelsProto2("some.id", c.tags), "1", "1400000000")
+		queued := len(promwrite_read) == 1
+		if queued != c.ok {
+			t.Errorf("%v: expected queued to be %v", c.tags, c.ok)
+		}
+		if counted := promwrite_invalid_total.val.Count() - invalid; counted != 0 == c.ok {
+			t.Errorf("%v: counted %d as invalid", c.tags, counted)
+		}
+		if queued {
+			s := <-promwrite_read
+			for i := 1; i < len(s.labels); i++ {
+				if s.labels[i].name <= s.labels[i-1].name {
+					t.Errorf("%v: labels not sorted and unique: %v", c.tags, s.labels)
+				}
+			}
+			if s.ts != 1400000000000 {
+				t.Errorf("%v: expected timestamp in ms, got %d", c.tags, s.ts)
+			}
+		}
+	}
+}
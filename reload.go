@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// on SIGHUP, we re-read the config files (see configdir.go) and apply the settings that can be changed at runtime.
+// we read the files with go-toml directly rather than re-parsing into the config variables,
+// because those are read all over the place without synchronisation.
+// settings that can be reloaded:
+// * in.port: we start listening on the new port, and drain the connections on the old one for in.drain_period seconds.
+//   portChanged is called with the new port, for whatever sends to our own port (see stats.as_proto2)
+// * in.ip_blocklist and in.ip_allowlist: apply to new connections
+// we also handle the other signals here: SIGUSR1 writes a heap snapshot (with -heapsnapshot),
+// and SIGINT and SIGTERM make us return the current listener and the ones still draining, so that main can shut
+// them all down (see shutdown.go).
+
+func handleSignals(current *listener, portChanged func(port int)) []*listener {
+	var draining []*listener
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
+	for s := range sig {
+		switch s {
+		case syscall.SIGINT, syscall.SIGTERM:
+			fmt.Printf("%s received, shutting down\n", s)
+			return append(draining, current)
+		case syscall.SIGUSR1:
+			if *heapsnapshot == "" {
+				fmt.Println("SIGUSR1 received, but -heapsnapshot is not set")
+			} else {
+				writeHeapSnapshot(*heapsnapshot)
+			}
+			continue
+		}
+		fmt.Println("SIGHUP received, reloading config")
+		next, err := reload(current)
+		if err != nil {
+			fmt.Printf("WARN could not reload config: %s\n", err.Error())
+			continue
+		}
+		if next != current {
+			go next.serve()
+			current.drain(time.Duration(*in_drain_period) * time.Second)
+			draining = append(stillOpen(draining), current)
+			current = next
+			portChanged(current.port)
+		}
+	}
+	return append(draining, current)
+}
+
+// reload re-reads the config and applies it. if in.port changed, it returns a listener for the new port,
+// which isn't serving yet. otherwise it returns current.
+func reload(current *listener) (*listener, error) {
+	tree, err := loadConfigTrees()
+	if err != nil {
+		return nil, err
+	}
+	blocklist, ok1 := tree.GetDefault("in.ip_blocklist", "").(string)
+	allowlist, ok2 := tree.GetDefault("in.ip_allowlist", "").(string)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("in.ip_blocklist and in.ip_allowlist must be strings")
+	}
+	filter, err := newIpFilter(blocklist, allowlist)
+	if err != nil {
+		return nil, err
+	}
+	port, ok := tree.GetDefault("in.port", int64(2003)).(int64)
+	if !ok {
+		return nil, fmt.Errorf("in.port is not an integer")
+	}
+	setIpFilter(filter)
+	if int(port) == current.port {
+		return current, nil
+	}
+	next, err := newListener(int(port), current.proto)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on new port %d, staying on %d: %s", port, current.port, err.Error())
+	}
+	return next, nil
+}
+
+// stillOpen returns the draining listeners that still have connections open
+func stillOpen(draining []*listener) []*listener {
+	var open []*listener
+	for _, l := range draining {
+		if l.numConns() > 0 {
+			open = append(open, l)
+		}
+	}
+	return open
+}
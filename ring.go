@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// with out.routing = consistent_hash, every metric is forwarded to only one destination, picked by a consistent hash
+// of its id, like carbon-relay does. every destination gets a number of points on a ring, and a metric goes to the
+// destination of the first point at or after the hash of its id. so when a destination is added or removed,
+// only the metrics whose nearest point changes move, roughly 1/n of them, rather than all of them.
+// (the ring is built at startup from out.destinations, so changing them requires a restart)
+
+const ringReplicas = 100 // points per destination. more means a more even spread
+
+type ringPoint struct {
+	pos  uint32
+	dest *destination
+}
+
+type ring []ringPoint
+
+func (r ring) Len() int           { return len(r) }
+func (r ring) Less(i, j int) bool { return r[i].pos < r[j].pos }
+func (r ring) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func ringHash(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// newRing places the destinations on the ring. their points only depend on their address,
+// not on the other destinations, which is what keeps the reshuffling minimal.
+func newRing(dests []*destination) *ring {
+	r := make(ring, 0, len(dests)*ringReplicas)
+	for _, dest := range dests {
+		for i := 0; i < ringReplicas; i++ {
+			r = append(r, ringPoint{ringHash(fmt.Sprintf("%s:%d", dest.addr, i)), dest})
+		}
+	}
+	sort.Sort(r)
+	return &r
+}
+
+// get returns the destination for a metric id. the ring must not be empty.
+func (r *ring) get(id string) *destination {
+	points := *r
+	h := ringHash(id)
+	i := sort.Search(len(points), func(i int) bool { return points[i].pos >= h })
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].dest
+}
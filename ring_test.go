@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringDestinations(n int) []*destination {
+	var dests []*destination
+	for i := 0; i < n; i++ {
+		dests = append(dests, testDestination(fmt.Sprintf("10.0.0.%d:2003", i+1)))
+	}
+	return dests
+}
+
+func ringIds(n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, fmt.Sprintf("unit=B.what=foo.server=web%d", i))
+	}
+	return ids
+}
+
+func TestRingStable(t *testing.T) {
+	dests := ringDestinations(3)
+	r := newRing(dests)
+	// the order of the destinations doesn't matter, only their addresses do
+	reversed := newRing([]*destination{testDestination(dests[2].addr), testDestination(dests[1].addr), testDestination(dests[0].addr)})
+	counts := make(map[string]int)
+	for _, id := range ringIds(3000) {
+		dest := r.get(id)
+		if again := r.get(id); again != dest {
+			t.Fatalf("%s: went to %s, and then to %s", id, dest.addr, again.addr)
+		}
+		if other := reversed.get(id); other.addr != dest.addr {
+			t.Errorf("%s: went to %s, but to %s with the destinations in another order", id, dest.addr, other.addr)
+		}
+		counts[dest.addr]++
+	}
+	// every destination gets a fair share
+	for _, dest := range dests {
+		if n := counts[dest.addr]; n < 600 || n > 1400 {
+			t.Errorf("%s: got %d of 3000 metrics, expected about 1000", dest.addr, n)
+		}
+	}
+}
+
+func TestRingMinimalReshuffle(t *testing.T) {
+	dests := ringDestinations(4)
+	ids := ringIds(4000)
+	before := newRing(dests[:3])
+	after := newRing(dests)
+
+	// adding a destination only moves metrics to that destination, about 1/4 of them
+	moved := 0
+	for _, id := range ids {
+		from, to := before.get(id), after.get(id)
+		if from == to {
+			continue
+		}
+		moved++
+		if to != dests[3] {
+			t.Errorf("%s: moved from %s to %s, rather than to the new destination", id, from.addr, to.addr)
+		}
+	}
+	if moved < 600 || moved > 1400 {
+		t.Errorf("adding a destination moved %d of 4000 metrics, expected about 1000", moved)
+	}
+
+	// removing one only moves the metrics it had
+	removed := newRing([]*destination{dests[0], dests[2], dests[3]})
+	for _, id := range ids {
+		from, to := after.get(id), removed.get(id)
+		if from != to && from != dests[1] {
+			t.Errorf("%s: moved from %s to %s, though %s is still there", id, from.addr, to.addr, from.addr)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	m20 "github.com/metrics20/go-metrics20"
+	"reflect"
+	"time"
+)
+
+// with parse.shadow, every proto2 metric is also parsed by candidateParser, and we count (and now and then log)
+// the metrics for which it disagrees with parseTagBasedMetric. the production path only ever uses parseTagBasedMetric,
+// so this lets us validate a parser change against real traffic before cutting over.
+// the candidate is compiled in with the parser_candidate build tag (see shadow_candidate.go).
+var candidateParser func(metric_id string) (*m20.MetricSpec, error)
+
+var shadow_last_log time.Time
+
+// shadowParse runs the candidate parser on a metric id that parseTagBasedMetric returned metric, err for
+func shadowParse(metric_id string, metric *m20.MetricSpec, err error) {
+	cand_metric, cand_err := candidateParser(metric_id)
+	diff := shadowDiff(metric, err, cand_metric, cand_err)
+	if diff == "" {
+		return
+	}
+	parse_shadow_diverged_total.Inc(1)
+	now := time.Now()
+	if now.Sub(shadow_last_log) >= time.Duration(*parse_shadow_log_int)*time.Second {
+		shadow_last_log = now
+		fmt.Printf("WARN candidate parser disagrees on '%s': %s\n", metric_id, diff)
+	}
+}
+
+// shadowDiff describes how the candidate result differs from the current one, or returns "" if they agree
+func shadowDiff(metric *m20.MetricSpec, err error, cand_metric *m20.MetricSpec, cand_err error) string {
+	switch {
+	case err != nil && cand_err != nil:
+		r, ok := err.(rejection)
+		cand_r, cand_ok := cand_err.(rejection)
+		if ok != cand_ok || ok && r.reason != cand_r.reason {
+			return fmt.Sprintf("current rejects with '%s', candidate with '%s'", err.Error(), cand_err.Error())
+		}
+		return ""
+	case err != nil:
+		return fmt.Sprintf("current rejects with '%s', candidate accepts as %s %v", err.Error(), cand_metric.Id, cand_metric.Tags)
+	case cand_err != nil:
+		return fmt.Sprintf("current accepts as %s %v, candidate rejects with '%s'", metric.Id, metric.Tags, cand_err.Error())
+	case metric.Id != cand_metric.Id || !reflect.DeepEqual(metric.Tags, cand_metric.Tags):
+		return fmt.Sprintf("current parses as %s %v, candidate as %s %v", metric.Id, metric.Tags, cand_metric.Id, cand_metric.Tags)
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+//go:build parser_candidate
+// +build parser_candidate
+
+package main
+
+import (
+	m20 "github.com/metrics20/go-metrics20"
+)
+
+// this is where the parser under test goes, when validating it with parse.shadow.
+// build with `go build -tags parser_candidate` to include it.
+// as is, the candidate is the current parser, so nothing should diverge.
+
+func init() {
+	candidateParser = parseCandidate
+}
+
+func parseCandidate(metric_id string) (*m20.MetricSpec, error) {
+	metric, _, err := parseTagBasedMetric(metric_id)
+	return metric, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// on SIGINT or SIGTERM we shut down cleanly: we stop accepting connections and close the open ones,
+// wait (at most in.drain_period seconds) for everything that was read to make its way through the pipeline,
+// flush the ES indexers and submit the stats one last time. then main returns, so that the profiles requested
+// with -cpuprofile and -memprofile get written, and reflect the steady state rather than an abrupt exit.
+
+// pipelineLen returns how many items are still queued somewhere between the input and our outputs
+func pipelineLen() int {
+	n := len(proto1_read) + len(proto2_read) + len(promwrite_read) + len(webhook_events)
+	for _, dest := range destinations {
+		n += len(dest.lines)
+	}
+	return n
+}
+
+// waitDrained waits until the pipeline has been empty for a little while (so that whatever a worker
+// took off a queue but hadn't passed on yet, has also made it through), or until the timeout.
+func waitDrained(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	quiet := 0
+	for quiet < 3 {
+		if time.Now().After(deadline) {
+			fmt.Printf("WARN gave up waiting for the pipeline to drain, %d items left\n", pipelineLen())
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		if pipelineLen() == 0 {
+			quiet++
+		} else {
+			quiet = 0
+		}
+	}
+}
+
+// writeHeapSnapshot writes a heap profile to <prefix>.<unix timestamp>, for live diagnosis on SIGUSR1
+func writeHeapSnapshot(prefix string) {
+	path := fmt.Sprintf("%s.%d", prefix, time.Now().Unix())
+	f, err := os.Create(path)
+	if err != nil {
+		fmt.Printf("WARN could not write heap snapshot: %s\n", err.Error())
+		return
+	}
+	defer f.Close()
+	// the heap profile is as of the last GC. make sure it's current
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	if err != nil {
+		fmt.Printf("WARN could not write heap snapshot: %s\n", err.Error())
+		return
+	}
+	fmt.Printf("wrote heap snapshot to %s\n", path)
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	m2 "github.com/vimeo/carbon-tagger/_third_party/github.com/metrics20/go-metrics20"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // note in metrics2.0 counter is a type of gauge that only increases
@@ -78,3 +86,174 @@ func (s *stat) Update(v int64) {
 	s.val.Clear()
 	s.val.Inc(v)
 }
+
+// sampledTimer is a go-metrics timer that only times 1 in every so many calls,
+// so that it can be used in the hot path without dominating it.
+// it is not safe for concurrent use: every goroutine needs its own.
+type sampledTimer struct {
+	metrics.Timer
+	every int
+	n     int
+}
+
+// NewTimer creates a timer (reported in ns) that times 1 in every `every` calls
+func NewTimer(key string, every int) *sampledTimer {
+	name := fmt.Sprintf("service_is_carbon-tagger.instance_is_%s.%s", *stats_id, key)
+	t := &sampledTimer{Timer: metrics.NewTimer(), every: every}
+	err := metrics.Register(name, t.Timer)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Start returns the start time if this call is sampled, or the zero time if not
+func (t *sampledTimer) Start() time.Time {
+	t.n++
+	if t.n < t.every {
+		return time.Time{}
+	}
+	t.n = 0
+	return time.Now()
+}
+
+// Stop records the duration since start, if the call was sampled
+func (t *sampledTimer) Stop(start time.Time) {
+	if !start.IsZero() {
+		t.UpdateSince(start)
+	}
+}
+
+// NewHistogram creates a histogram of the values it's updated with, biased towards the last 5 minutes
+// (the same sampling as the timers use)
+func NewHistogram(key string) metrics.Histogram {
+	name := fmt.Sprintf("service_is_carbon-tagger.instance_is_%s.%s", *stats_id, key)
+	h := metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	err := metrics.Register(name, h)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// WriteGraphite writes the current values of the metrics in c.Registry to w, like a submission by go-metrics'
+// Graphite reporter would, but without connecting to c.Addr, so that we can buffer the submissions (see statsReporter)
+func WriteGraphite(c *metrics.GraphiteConfig, w io.Writer) {
+	now := time.Now().Unix()
+	du := float64(c.DurationUnit)
+	c.Registry.Each(func(name string, i interface{}) {
+		k := c.Prefix + name
+		switch metric := i.(type) {
+		case metrics.Counter:
+			fmt.Fprintf(w, "%s %d %d\n", m2.Counter(k, ""), metric.Count(), now)
+		case metrics.Gauge:
+			fmt.Fprintf(w, "%s %d %d\n", m2.Gauge(k, ""), metric.Value(), now)
+		case metrics.GaugeFloat64:
+			fmt.Fprintf(w, "%s %f %d\n", m2.Gauge(k, ""), metric.Value(), now)
+		case metrics.Histogram:
+			h := metric.Snapshot()
+			ps := h.Percentiles(c.Percentiles)
+			fmt.Fprintf(w, "%s %d %d\n", m2.CountMetric(k, ""), h.Count(), now)
+			fmt.Fprintf(w, "%s %d %d\n", m2.Min(k, "", "", ""), h.Min(), now)
+			fmt.Fprintf(w, "%s %d %d\n", m2.Max(k, "", "", ""), h.Max(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "", "", ""), h.Mean(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Std(k, "", "", ""), h.StdDev(), now)
+			for psIdx, psKey := range c.Percentiles {
+				pct := strings.Replace(strconv.FormatFloat(psKey*100.0, 'f', -1, 64), ".", "", 1)
+				fmt.Fprintf(w, "%s %.2f %d\n", m2.Max(k, "", pct, ""), ps[psIdx], now)
+			}
+		case metrics.Meter:
+			m := metric.Snapshot()
+			fmt.Fprintf(w, "%s %d %d\n", m2.CountMetric(k, ""), m.Count(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "1m", "", "60"), m.Rate1(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "5m", "", "300"), m.Rate5(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "15m", "", "900"), m.Rate15(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "start", "", "start"), m.RateMean(), now)
+		case metrics.Timer:
+			t := metric.Snapshot()
+			ps := t.Percentiles(c.Percentiles)
+			fmt.Fprintf(w, "%s %d %d\n", m2.CountMetric(k, ""), t.Count(), now)
+			fmt.Fprintf(w, "%s %d %d\n", m2.Min(k, "", "", ""), t.Min()/int64(du), now)
+			fmt.Fprintf(w, "%s %d %d\n", m2.Max(k, "", "", ""), t.Max()/int64(du), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "", "", ""), t.Mean()/du, now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Std(k, "", "", ""), t.StdDev()/du, now)
+			for psIdx, psKey := range c.Percentiles {
+				pct := strings.Replace(strconv.FormatFloat(psKey*100.0, 'f', -1, 64), ".", "", 1)
+				fmt.Fprintf(w, "%s %.2f %d\n", m2.Max(k, "", pct, ""), ps[psIdx], now)
+			}
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "1m", "", "60"), t.Rate1(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "5m", "", "300"), t.Rate5(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "15m", "", "900"), t.Rate15(), now)
+			fmt.Fprintf(w, "%s %.2f %d\n", m2.Mean(k, "start", "", "start"), t.RateMean(), now)
+		}
+	})
+}
+
+// statsReporter reports the stats to dest every flush interval. stats are nice to have, but our job is ingest,
+// so when dest is unreachable (or doesn't even resolve, e.g. when DNS is flaky at startup) we just warn, and keep
+// the last stats.buffer_flushes submissions we couldn't send, to send them once dest is back. older ones are dropped.
+type statsReporter struct {
+	dest string
+	c    metrics.GraphiteConfig
+
+	sync.Mutex
+	pending [][]byte // oldest first
+}
+
+func newStatsReporter(dest string, c metrics.GraphiteConfig) *statsReporter {
+	return &statsReporter{dest: dest, c: c}
+}
+
+// setDest makes the next flushes go to dest, e.g. when we move to a different port with stats.as_proto2
+func (r *statsReporter) setDest(dest string) {
+	r.Lock()
+	r.dest = dest
+	r.Unlock()
+}
+
+func (r *statsReporter) run() {
+	for _ = range time.Tick(r.c.FlushInterval) {
+		err := r.flush()
+		if err != nil {
+			r.Lock()
+			n, dest := len(r.pending), r.dest
+			r.Unlock()
+			fmt.Printf("WARN could not submit stats to %s, %d submissions buffered: %s\n", dest, n, err.Error())
+		}
+	}
+}
+
+// flush takes the current stats, and sends them along with whatever is still buffered.
+// of what we couldn't send, we keep the last stats.buffer_flushes submissions for the next flush.
+func (r *statsReporter) flush() error {
+	var buf bytes.Buffer
+	WriteGraphite(&r.c, &buf)
+	r.Lock()
+	defer r.Unlock()
+	r.pending = append(r.pending, buf.Bytes())
+	err := r.send()
+	if n := len(r.pending) - *stats_buffer_flushes; n > 0 {
+		stats_flushes_dropped_total.Inc(int64(n))
+		r.pending = r.pending[n:]
+	}
+	return err
+}
+
+// send sends the pending submissions to dest, oldest first. the caller must hold the lock,
+// so don't let a stuck dest hold us up forever.
+func (r *statsReporter) send() error {
+	conn, err := net.DialTimeout("tcp", r.dest, r.c.FlushInterval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(r.c.FlushInterval))
+	for len(r.pending) > 0 {
+		_, err = conn.Write(r.pending[0])
+		if err != nil {
+			return err
+		}
+		r.pending = r.pending[1:]
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/vimeo/carbon-tagger/_third_party/github.com/Dieterbe/go-metrics"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStatsServer accepts connections on a free port, and sends what it receives over each one on received
+type fakeStatsServer struct {
+	l        net.Listener
+	received chan string
+}
+
+func newFakeStatsServer(t *testing.T, addr string) *fakeStatsServer {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeStatsServer{l, make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			data, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			s.received <- string(data)
+		}
+	}()
+	return s
+}
+
+func (s *fakeStatsServer) addr() string {
+	return s.l.Addr().String()
+}
+
+// receive returns what the next connection sent
+func (s *fakeStatsServer) receive(t *testing.T) string {
+	select {
+	case data := <-s.received:
+		return data
+	case <-time.After(time.Second):
+		t.Fatalf("%s didn't receive anything", s.addr())
+	}
+	return ""
+}
+
+// testStatsReporter reports a registry with a single counter, set to value
+func testStatsReporter(dest string, value int64) *statsReporter {
+	c := metrics.NewCounter()
+	c.Inc(value)
+	r := metrics.NewRegistry()
+	r.Register("unit_is_Metric.what_is_test", c)
+	return newStatsReporter(dest, metrics.GraphiteConfig{Registry: r, FlushInterval: time.Second, DurationUnit: time.Nanosecond})
+}
+
+func TestStatsReporterSetDest(t *testing.T) {
+	old, next := newFakeStatsServer(t, "127.0.0.1:0"), newFakeStatsServer(t, "127.0.0.1:0")
+	defer old.l.Close()
+	defer next.l.Close()
+	r := testStatsReporter(old.addr(), 42)
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data := old.receive(t); !strings.HasPrefix(data, "unit_is_Metric.what_is_test.target_type_is_counter 42 ") {
+		t.Errorf("unexpected stats %q", data)
+	}
+	r.setDest(next.addr())
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data := next.receive(t); !strings.HasPrefix(data, "unit_is_Metric.what_is_test.target_type_is_counter 42 ") {
+		t.Errorf("unexpected stats %q", data)
+	}
+	select {
+	case data := <-old.received:
+		t.Errorf("old destination still got %q", data)
+	default:
+	}
+}
+
+func TestStatsReporterUnresolvableHost(t *testing.T) {
+	r := testStatsReporter("stats.invalid:2003", 42) // .invalid never resolves
+	if err := r.flush(); err == nil {
+		t.Fatalf("expected an error for an unresolvable host")
+	}
+	// the stats we couldn't submit are kept
+	r.Lock()
+	n := len(r.pending)
+	r.Unlock()
+	if n != 1 {
+		t.Errorf("expected 1 submission to be buffered, got %d", n)
+	}
+
+	// and it doesn't keep us from taking metrics
+	lines_read = make(chan inLine, 10)
+	defer func() { lines_read = nil }()
+	l := testListener(t)
+	go l.serve()
+	defer l.shutdown()
+	conn := dialTest(t, l, 1)
+	defer conn.Close()
+	conn.Write([]byte("foo.bar 1 1400000000\n"))
+	select {
+	case line := <-lines_read:
+		if string(line.buf) != "foo.bar 1 1400000000\n" {
+			t.Errorf("unexpected line %q", line.buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the listener didn't read the line")
+	}
+}
+
+func TestStatsReporterBuffersWhileDown(t *testing.T) {
+	defer setInt(stats_buffer_flushes, 3)()
+	s := newFakeStatsServer(t, "127.0.0.1:0")
+	addr := s.addr()
+	r := testStatsReporter(addr, 1)
+	counter := r.c.Registry.Get("unit_is_Metric.what_is_test").(metrics.Counter)
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data := s.receive(t); !strings.HasPrefix(data, "unit_is_Metric.what_is_test.target_type_is_counter 1 ") {
+		t.Errorf("unexpected stats %q", data)
+	}
+
+	// while it's down, we keep the last 3 submissions
+	s.l.Close()
+	dropped := stats_flushes_dropped_total.val.Count()
+	for i := 2; i <= 5; i++ {
+		counter.Inc(1)
+		if err := r.flush(); err == nil {
+			t.Fatalf("flush %d: expected an error while the stats server is down", i)
+		}
+	}
+	r.Lock()
+	n := len(r.pending)
+	r.Unlock()
+	if n != 3 {
+		t.Errorf("expected 3 submissions to be buffered, got %d", n)
+	}
+	if n := stats_flushes_dropped_total.val.Count() - dropped; n != 1 {
+		t.Errorf("expected 1 dropped submission, got %d", n)
+	}
+
+	// once it's back, they get sent along with the current one, oldest first
+	s = newFakeStatsServer(t, addr)
+	defer s.l.Close()
+	counter.Inc(1)
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, line := range strings.Split(strings.TrimSpace(s.receive(t)), "\n") {
+		values = append(values, strings.Fields(line)[1])
+	}
+	// the limit is on what we couldn't send, so the current one doesn't push out another
+	if strings.Join(values, " ") != "3 4 5 6" {
+		t.Errorf("expected the submissions with values 3 4 5 6, got %v", values)
+	}
+	if n := stats_flushes_dropped_total.val.Count() - dropped; n != 1 {
+		t.Errorf("expected 1 dropped submission, got %d", n)
+	}
+}
+
+func TestStatsReporterNoBuffer(t *testing.T) {
+	defer setInt(stats_buffer_flushes, 0)()
+	s := newFakeStatsServer(t, "127.0.0.1:0")
+	defer s.l.Close()
+	r := testStatsReporter(s.addr(), 42)
+	// the current submission is always sent
+	if err := r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if data := s.receive(t); !strings.HasPrefix(data, "unit_is_Metric.what_is_test.target_type_is_counter 42 ") {
+		t.Errorf("unexpected stats %q", data)
+	}
+
+	// but when it can't be, it's dropped rather than kept
+	r.setDest("stats.invalid:2003")
+	dropped := stats_flushes_dropped_total.val.Count()
+	if err := r.flush(); err == nil {
+		t.Fatalf("expected an error for an unresolvable host")
+	}
+	r.Lock()
+	n := len(r.pending)
+	r.Unlock()
+	if n != 0 {
+		t.Errorf("expected no submissions to be buffered, got %d", n)
+	}
+	if n := stats_flushes_dropped_total.val.Count() - dropped; n != 1 {
+		t.Errorf("expected 1 dropped submission, got %d", n)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// logStatus periodically prints a summary of how the pipeline is doing.
+// it only reads the stats, so it doesn't interfere with the regular stats reporting.
+func logStatus(interval time.Duration, targets []esTarget, indexers ...Indexer) {
+	var p1good, p1bad, p2good, p2bad int64
+	for _ = range time.Tick(interval) {
+		n1good, n1bad := in_metrics_proto1_good_total.val.Count(), in_metrics_proto1_bad_total.val.Count()
+		n2good, n2bad := in_metrics_proto2_good_total.val.Count(), in_metrics_proto2_bad_total.val.Count()
+		errors := uint64(0)
+		for _, t := range targets {
+			errors += uint64(t.err.val.Count())
+		}
+		for _, indexer := range indexers {
+			errors += indexer.NumErrors()
+		}
+		secs := interval.Seconds()
+		fmt.Printf("INFO status: conns=%d proto1 good=%.1f/s bad=%.1f/s proto2 good=%.1f/s bad=%.1f/s proto2_queue=%d es_errors=%d\n",
+			in_conns_current.val.Count(),
+			float64(n1good-p1good)/secs, float64(n1bad-p1bad)/secs,
+			float64(n2good-p2good)/secs, float64(n2bad-p2bad)/secs,
+			len(proto2_read), errors)
+		p1good, p1bad, p2good, p2bad = n1good, n1bad, n2good, n2bad
+	}
+}
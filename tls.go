@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// with in.tls_cert and in.tls_key set, clients connect over TLS. with in.tls_client_ca as well, they must present
+// a certificate signed by that CA, and with in.identity_tag, the identity in that certificate (its CN, or its first
+// DNS SAN) is set as that tag on all proto2 metrics from the connection. that tells us who sent a metric much more
+// reliably than an IP. it overrides whatever value the sender set for that tag itself, so it can't be spoofed.
+// (its cardinality is bounded by the number of client certificates)
+// the tag is not added to the metric id, and trackProto2 only indexes the first metric it sees with a given id.
+// so when several senders send the same metric, its document has the identity of whichever came first.
+
+var in_tls *tls.Config // nil if we don't do TLS
+
+func loadTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if cert == "" && key == "" {
+		if clientCA != "" {
+			return nil, fmt.Errorf("in.tls_client_ca requires in.tls_cert and in.tls_key")
+		}
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{pair}}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientIdentity does the TLS handshake, and returns the identity of the client's verified certificate, if any
+func clientIdentity(conn *tls.Conn) (string, error) {
+	// don't let a client that never finishes the handshake tie up the connection forever
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", nil
+	}
+	cert := chains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], nil
+	}
+	return "", nil
+}
+
+// wrapTLS makes an accepted connection a TLS one, if we do TLS
+func wrapTLS(conn net.Conn) net.Conn {
+	if in_tls == nil {
+		return conn
+	}
+	return tls.Server(conn, in_tls)
+}
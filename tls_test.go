@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by parent, or self-signed if parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// writePEM writes the certificate and its key into dir, and returns their paths
+func (c *testCert) writePEM(t *testing.T, dir, name string) (string, string) {
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSListenerIdentityTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-tagger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "carbon-tagger"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "web1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	// not signed by our CA
+	stranger := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "web2"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := server.writePEM(t, dir, "server")
+
+	config, err := loadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *tls.Config) { in_tls = old }(in_tls)
+	in_tls = config
+	defer setString(in_identity_tag, "sender")()
+	lines_read = make(chan inLine, 10)
+	defer func() { lines_read = nil }()
+	l := testListener(t)
+	go l.serve()
+	defer l.shutdown()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(cert *testCert) (*tls.Conn, error) {
+		return tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", l.port), &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert.tlsCertificate()},
+		})
+	}
+
+	failed := in_conns_tls_failed_total.val.Count()
+	conn, err := dial(stranger)
+	if err == nil {
+		// with TLS 1.3, the client only learns that it was refused when it reads
+		conn.Write([]byte("sender=web1.unit=B.target_type=gauge.what=foo 1 1400000000\n"))
+		expectClosed(t, conn)
+		conn.Close()
+	}
+	for i := 0; in_conns_tls_failed_total.val.Count() == failed; i++ {
+		if i == 100 {
+			t.Fatalf("expected the connection without a valid certificate to fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err = dial(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the sender can't pretend to be someone else
+	conn.Write([]byte("sender=web2.unit=B.target_type=gauge.what=foo 1 1400000000\n"))
+	var line inLine
+	select {
+	case line = <-lines_read:
+	case <-time.After(time.Second):
+		t.Fatalf("the listener didn't read the line")
+	}
+	if n := len(lines_read); n != 0 {
+		t.Errorf("expected only the line of the valid client, got %d more", n)
+	}
+	_, p2 := processLines(line)
+	if len(p2) != 1 {
+		t.Fatalf("expected 1 proto2 metric, got %v", p2)
+	}
+	if sender := p2[0].Tags["sender"]; sender != "web1" {
+		t.Errorf("expected the sender tag to be the client's CN web1, got %q", sender)
+	}
+	// but it stays in the id as it was sent
+	if p2[0].Id != "sender=web2.unit=B.target_type=gauge.what=foo" {
+		t.Errorf("expected the metric id to be left alone, got %s", p2[0].Id)
+	}
+}
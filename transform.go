@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// transformations of metric ids, applied in order to every incoming id before we classify it.
+// configured in parse.id_transforms, one per line:
+//   prefix <string>                  adds a prefix
+//   suffix <string>                  adds a suffix
+//   replace <regex> <replacement>    replaces all matches of the regex; the replacement can use $1 etc
+//                                    (an empty replacement removes the matches)
+
+type idTransform func(id string) string
+
+var id_transforms []idTransform
+
+func initIdTransforms(spec string) error {
+	id_transforms = nil
+	for _, line := range strings.Split(spec, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch {
+		case fields[0] == "prefix" && len(fields) == 2:
+			prefix := fields[1]
+			id_transforms = append(id_transforms, func(id string) string { return prefix + id })
+		case fields[0] == "suffix" && len(fields) == 2:
+			suffix := fields[1]
+			id_transforms = append(id_transforms, func(id string) string { return id + suffix })
+		case fields[0] == "replace" && (len(fields) == 2 || len(fields) == 3):
+			re, err := regexp.Compile(fields[1])
+			if err != nil {
+				return fmt.Errorf("invalid id transform '%s': %s", line, err.Error())
+			}
+			repl := ""
+			if len(fields) == 3 {
+				repl = fields[2]
+			}
+			id_transforms = append(id_transforms, func(id string) string { return re.ReplaceAllString(id, repl) })
+		default:
+			return fmt.Errorf("invalid id transform '%s'", line)
+		}
+	}
+	return nil
+}
+
+func transformId(id string) string {
+	for _, t := range id_transforms {
+		id = t(id)
+	}
+	return id
+}
+
+// withId builds the line with a different metric id, for when we changed it
+func withId(id string, elements []string) []byte {
+	return []byte(fmt.Sprintf("%s %s %s\n", id, elements[1], elements[2]))
+}
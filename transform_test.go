@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTransformId(t *testing.T) {
+	defer initIdTransforms("")
+	cases := []struct {
+		spec string
+		id   string
+		out  string
+	}{
+		{"", "servers.web1.cpu", "servers.web1.cpu"},
+		{"prefix prod.", "servers.web1.cpu", "prod.servers.web1.cpu"},
+		{"suffix .total", "servers.web1.cpu", "servers.web1.cpu.total"},
+		{`replace ^staging\.`, "staging.servers.web1.cpu", "servers.web1.cpu"},
+		{`replace web(\d+) host$1`, "servers.web1.cpu.web2", "servers.host1.cpu.host2"},
+		// in order: the replace sees the prefix, the suffix comes after the replace
+		{"prefix prod.\nreplace ^prod\\.servers dc1\nsuffix .x", "servers.web1.cpu", "dc1.web1.cpu.x"},
+		{"replace ^prod\\.servers dc1\nprefix prod.", "servers.web1.cpu", "prod.servers.web1.cpu"},
+		{"\n  prefix a.\n\n", "b", "a.b"}, // blank lines are fine
+	}
+	for _, c := range cases {
+		err := initIdTransforms(c.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error %q", c.spec, err)
+			continue
+		}
+		if out := transformId(c.id); out != c.out {
+			t.Errorf("%q: expected %s to become %s, got %s", c.spec, c.id, c.out, out)
+		}
+	}
+}
+
+func TestInitIdTransformsInvalid(t *testing.T) {
+	defer initIdTransforms("")
+	for _, spec := range []string{"prefix", "prefix a b", "suffix", "replace", "replace a b c", "replace ( x", "upper"} {
+		if err := initIdTransforms(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+// the transformed id is what gets indexed and forwarded, and it's what we classify
+func TestProcessInputLinesTransformsIds(t *testing.T) {
+	defer initIdTransforms("")
+	err := initIdTransforms("replace ^env=prod\\.\nprefix unit=B.target_type=gauge.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := processLines(inLine{buf: []byte("env=prod.what=foo 1 1400000000\n"), proto: protoAuto})
+	if len(p1) != 0 || len(p2) != 1 {
+		t.Fatalf("expected one proto2 metric, got %v and %v", p1, p2)
+	}
+	if p2[0].Id != "unit=B.target_type=gauge.what=foo" {
+		t.Errorf("expected the transformed id, got %s", p2[0].Id)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// optional notifications about metrics we see for the first time, posted as a JSON array to webhook.url.
+// events are batched, and we post at most once every webhook.flush_interval, which also rate-limits us during
+// onboarding bursts. if the backlog of events fills up, new ones are dropped. failures are logged, never fatal.
+
+type webhookEvent struct {
+	Id        string            `json:"id"`
+	Tags      map[string]string `json:"tags"`
+	Timestamp int64             `json:"timestamp"`
+	Source    string            `json:"source"`
+}
+
+// notifyNewMetric queues an event for the webhook, if enabled
+func notifyNewMetric(metric trackedMetric, date time.Time) {
+	if webhook_events == nil {
+		return
+	}
+	select {
+	case webhook_events <- webhookEvent{metric.Id, metric.Tags, date.Unix(), metric.source}:
+	default:
+		webhook_dropped_total.Inc(1)
+	}
+}
+
+func postWebhooks() {
+	client := &http.Client{Timeout: time.Duration(*webhook_timeout) * time.Second}
+	for _ = range time.Tick(time.Duration(*webhook_flush_int) * time.Second) {
+		n := len(webhook_events)
+		if n == 0 {
+			continue
+		}
+		if n > *webhook_batch_size {
+			n = *webhook_batch_size
+		}
+		batch := make([]webhookEvent, n)
+		for i := range batch {
+			batch[i] = <-webhook_events
+		}
+		err := postWebhook(client, batch)
+		if err != nil {
+			fmt.Printf("WARN could not post %d new metrics to webhook: %s\n", len(batch), err.Error())
+			webhook_errors_total.Inc(1)
+			continue
+		}
+		webhook_sent_total.Inc(int64(len(batch)))
+	}
+}
+
+func postWebhook(client *http.Client, batch []webhookEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(*webhook_url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}